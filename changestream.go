@@ -0,0 +1,222 @@
+package cmap
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// changeStreamBuffer is the default number of events buffered per shard
+// for every change stream, see WithChangeStreamBuffer.
+const changeStreamBuffer = 64
+
+// MutationOp is the kind of change carried by a MutationEvent.
+type MutationOp int
+
+const (
+	OpSet MutationOp = iota
+	OpDelete
+)
+
+func (op MutationOp) String() string {
+	switch op {
+	case OpSet:
+		return "Set"
+	case OpDelete:
+		return "Delete"
+	}
+	return "MutationOp(" + strconv.Itoa(int(op)) + ")"
+}
+
+// MutationEvent describes a change committed to a map, see ChangeStream.
+type MutationEvent[V any] struct {
+	// Seq increases with every event of the map, across all shards.
+	Seq uint64
+	Op  MutationOp
+	Key string
+	// Old is the value held before the change, if HadOld is set.
+	Old    V
+	HadOld bool
+	// New is the value set, zero for deletions.
+	New V
+}
+
+// changeStreams tracks the change streams of a map.
+type changeStreams[V any] struct {
+	// active is the number of open streams, checked by writers before
+	// taking mu.
+	active atomic.Int32
+	seq    atomic.Uint64
+	mu     sync.RWMutex
+	subs   map[*changeSub[V]]struct{}
+	// closed is set by Dispose, later streams are closed right away.
+	closed bool
+}
+
+// changeSub is a single change stream.
+type changeSub[V any] struct {
+	// shards queues the events of each shard, in commit order.
+	shards []chan MutationEvent[V]
+	done   chan struct{}
+	cancel func()
+}
+
+// WithChangeStreamBuffer sets the number of events every change stream
+// buffers per shard, 64 by default. Writers of a shard block once its
+// buffer of a stream is full, until the consumer catches up.
+func WithChangeStreamBuffer[V any](n int) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.streamBuffer = n
+	}
+}
+
+// ChangeStream returns a channel delivering the changes committed to the
+// map from now on, and a function stopping delivery and closing the
+// channel, which may be called more than once. Events of the same shard
+// arrive in commit order, there is no ordering across shards beyond Seq.
+//
+// Every write reports its changes, the batch and shard level ones and
+// transactions included: OpSet events for the keys set, OpDelete events
+// for the keys removed that were present, evictions included. Changes
+// made to raw items by WithShardWrite and LockShard are found by comparing
+// the shard before and after with reflect.DeepEqual. Dispose closes the streams
+// instead of reporting the items it releases, and streams of a disposed
+// map are closed from the start.
+//
+// Events are queued under the shard lock, so a consumer falling behind by
+// more than the buffer set with WithChangeStreamBuffer stalls the writers
+// of that shard.
+func (m *ConcurrentMap[V]) ChangeStream() (<-chan MutationEvent[V], func()) {
+	m.lazyInit()
+	buffer := m.streamBuffer
+	if buffer <= 0 {
+		buffer = changeStreamBuffer
+	}
+	sub := &changeSub[V]{
+		shards: make([]chan MutationEvent[V], m.shardCount),
+		done:   make(chan struct{}),
+	}
+	out := make(chan MutationEvent[V])
+	wg := sync.WaitGroup{}
+	wg.Add(m.shardCount)
+	for i := range sub.shards {
+		sub.shards[i] = make(chan MutationEvent[V], buffer)
+		go func(queue chan MutationEvent[V]) {
+			defer wg.Done()
+			for ev := range queue {
+				select {
+				case out <- ev:
+				case <-sub.done:
+				}
+			}
+		}(sub.shards[i])
+	}
+
+	streams := &m.streams
+	once := sync.Once{}
+	sub.cancel = func() {
+		once.Do(func() {
+			// Unblock writers waiting on a full queue, then wait for them
+			// to leave before closing the queues.
+			close(sub.done)
+			streams.mu.Lock()
+			delete(streams.subs, sub)
+			streams.active.Add(-1)
+			streams.mu.Unlock()
+			for _, queue := range sub.shards {
+				close(queue)
+			}
+			wg.Wait()
+			close(out)
+		})
+	}
+
+	streams.mu.Lock()
+	if streams.closed {
+		streams.mu.Unlock()
+		for _, queue := range sub.shards {
+			close(queue)
+		}
+		wg.Wait()
+		close(out)
+		return out, func() {}
+	}
+	if streams.subs == nil {
+		streams.subs = make(map[*changeSub[V]]struct{})
+	}
+	streams.subs[sub] = struct{}{}
+	streams.active.Add(1)
+	streams.mu.Unlock()
+	return out, sub.cancel
+}
+
+// closeStreams cancels every open change stream, and makes the ones
+// opened later start closed.
+func (m *ConcurrentMap[V]) closeStreams() {
+	streams := &m.streams
+	streams.mu.Lock()
+	streams.closed = true
+	subs := make([]*changeSub[V], 0, len(streams.subs))
+	for sub := range streams.subs {
+		subs = append(subs, sub)
+	}
+	streams.mu.Unlock()
+	for _, sub := range subs {
+		sub.cancel()
+	}
+}
+
+// streaming reports whether the map has open change streams.
+func (m *ConcurrentMap[V]) streaming() bool {
+	return m.streams.active.Load() > 0
+}
+
+// emit queues a change of key to every change stream. It must be called
+// with the lock of key's shard held, so events are queued in commit order.
+func (m *ConcurrentMap[V]) emit(op MutationOp, key string, old V, hadOld bool, val V) {
+	if !m.streaming() {
+		return
+	}
+	streams := &m.streams
+	streams.mu.RLock()
+	defer streams.mu.RUnlock()
+	ev := MutationEvent[V]{
+		Seq:    streams.seq.Add(1),
+		Op:     op,
+		Key:    key,
+		Old:    old,
+		HadOld: hadOld,
+		New:    val,
+	}
+	idx := m.shardIndex(key)
+	for sub := range streams.subs {
+		select {
+		case sub.shards[idx] <- ev:
+		case <-sub.done:
+		}
+	}
+}
+
+// emitDelete is emit for the removal of key, which held old.
+func (m *ConcurrentMap[V]) emitDelete(key string, old V) {
+	var zero V
+	m.emit(OpDelete, key, old, true, zero)
+}
+
+// emitDiff emits the changes turning the items before of a shard into the
+// items after, values being compared with reflect.DeepEqual. The shard's
+// write lock must be held.
+func (m *ConcurrentMap[V]) emitDiff(before, after map[string]V) {
+	for key, old := range before {
+		if _, ok := after[key]; !ok {
+			m.emitDelete(key, old)
+		}
+	}
+	for key, val := range after {
+		old, hadOld := before[key]
+		if !hadOld || !reflect.DeepEqual(old, val) {
+			m.emit(OpSet, key, old, hadOld, val)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cmap
+
+import (
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChangeStream(t *testing.T) {
+	m := New[int]()
+	m.Set("before", 1)
+	events, cancel := m.ChangeStream()
+
+	m.Set("a", 1)
+	m.Set("a", 2)
+	m.Upsert("a", 3, func(exist bool, valueInMap, newValue int) int {
+		return valueInMap + newValue
+	})
+	m.Remove("missing")
+	m.Remove("a")
+
+	expected := []MutationEvent[int]{
+		{Op: OpSet, Key: "a", New: 1},
+		{Op: OpSet, Key: "a", Old: 1, HadOld: true, New: 2},
+		{Op: OpSet, Key: "a", Old: 2, HadOld: true, New: 5},
+		{Op: OpDelete, Key: "a", Old: 5, HadOld: true},
+	}
+	var lastSeq uint64
+	for i, want := range expected {
+		ev := <-events
+		if ev.Seq <= lastSeq {
+			t.Errorf("event %d: sequence numbers should increase, got %d after %d", i, ev.Seq, lastSeq)
+		}
+		lastSeq = ev.Seq
+		ev.Seq = 0
+		if ev != want {
+			t.Errorf("event %d: expected %+v, got %+v", i, want, ev)
+		}
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("channel should be closed once cancelled.")
+	}
+	m.Set("after", 1)
+	if m.streaming() {
+		t.Error("cancelled streams should be unregistered.")
+	}
+}
+
+func TestChangeStreamPerShardOrder(t *testing.T) {
+	m := New[int](WithShardCount[int](4), WithChangeStreamBuffer[int](1))
+	events, cancel := m.ChangeStream()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.Set("k"+strconv.Itoa(w), i)
+			}
+		}(w)
+	}
+
+	last := make(map[string]int)
+	for n := 0; n < 400; n++ {
+		ev := <-events
+		if prev, ok := last[ev.Key]; ok && ev.New != prev+1 {
+			t.Errorf("%s: got %d after %d", ev.Key, ev.New, prev)
+		}
+		last[ev.Key] = ev.New
+	}
+	wg.Wait()
+	cancel()
+}
+
+func TestChangeStreamCancelUnblocksWriters(t *testing.T) {
+	m := New[int](WithShardCount[int](1), WithChangeStreamBuffer[int](1))
+	_, cancel := m.ChangeStream()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Nobody reads, the writer blocks once the buffer is full.
+		for i := 0; i < 10; i++ {
+			m.Set(strconv.Itoa(i), i)
+		}
+	}()
+	cancel()
+	<-done
+	if m.Count() != 10 {
+		t.Errorf("expected 10 elements, got %d", m.Count())
+	}
+}
+
+func TestChangeStreamReplicatesEveryWrite(t *testing.T) {
+	m := New[int](WithShardCount[int](1), WithChangeStreamBuffer[int](256))
+	events, cancel := m.ChangeStream()
+	defer cancel()
+
+	m.Transaction(func(tx *Tx[int]) error {
+		tx.Set("a", 1)
+		return nil
+	})
+	m.Transact([]string{"b"}, func(txn *Txn[int]) error {
+		txn.Set("b", 2)
+		return nil
+	})
+	m.Set("c", 3)
+	m.PopIf(func(key string, v int) bool { return key == "c" })
+	m.BatchUpsert(map[string]int{"e": 5}, func(exist bool, valueInMap, newValue int) int { return newValue })
+	m.MSetCount(map[string]int{"f": 6, "g": 7})
+	m.SplitByKey(func(key string) bool { return key == "g" })
+	m.WithShardWrite("f", func(items map[string]int) {
+		items["f"] = 60
+	})
+	for range m.PopAll() {
+	}
+	m.Set("d", 4)
+	m.WithShardWrite("d", func(items map[string]int) {
+		delete(items, "d")
+		items["d"] = 40
+	})
+	m.Set("h", 8)
+	m.Transaction(func(tx *Tx[int]) error {
+		tx.Remove("h")
+		return nil
+	})
+
+	expected := m.Items()
+	// With a single shard, the marker is delivered after every other event.
+	m.Set("end", 0)
+	replica := make(map[string]int)
+	for {
+		var ev MutationEvent[int]
+		select {
+		case ev = <-events:
+		case <-time.After(time.Second):
+			t.Fatalf("marker not delivered, replica is %v", replica)
+		}
+		if ev.Key == "end" {
+			break
+		}
+		if ev.Op == OpDelete {
+			delete(replica, ev.Key)
+		} else {
+			replica[ev.Key] = ev.New
+		}
+	}
+	if !reflect.DeepEqual(replica, expected) {
+		t.Errorf("replica %v does not match the map %v", replica, expected)
+	}
+}
+
+func TestChangeStreamClosedByDispose(t *testing.T) {
+	m := New[int]()
+	events, cancel := m.ChangeStream()
+	before := runtime.NumGoroutine()
+	m.Dispose()
+	if _, ok := <-events; ok {
+		t.Error("Dispose should close open streams.")
+	}
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before-m.shardCount && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before-m.shardCount {
+		t.Errorf("expected the %d forwarders to exit, %d goroutines left of %d", m.shardCount, n, before)
+	}
+
+	late, cancel := m.ChangeStream()
+	if _, ok := <-late; ok {
+		t.Error("streams of a disposed map should start closed.")
+	}
+	cancel()
+}
@@ -0,0 +1,105 @@
+package cmap
+
+import (
+	"context"
+	"reflect"
+)
+
+// Checkpoint is a point in time copy of a map, taken shard by shard with
+// ConcurrentMap.Checkpoint, that later states can be diffed against.
+type Checkpoint[V any] struct {
+	m      *ConcurrentMap[V]
+	shards []map[string]V
+}
+
+// Patch lists the changes of a single shard since a checkpoint.
+type Patch[V any] struct {
+	// Shard is the index of the shard the changes belong to.
+	Shard int
+	// Set holds the keys that were added or whose value changed.
+	Set map[string]V
+	// Removed holds the keys that are gone.
+	Removed []string
+}
+
+// Checkpoint copies the current contents of the map. Each shard is copied
+// under its read lock, so the checkpoint is consistent per shard but not
+// across shards.
+func (m *ConcurrentMap[V]) Checkpoint() *Checkpoint[V] {
+	m.lazyInit()
+	cp := &Checkpoint[V]{m: m, shards: make([]map[string]V, m.shardCount)}
+	for index, shard := range m.shards {
+		shard.rlock()
+		items := make(map[string]V, len(shard.items))
+		for key, val := range shard.items {
+			items[key] = val
+		}
+		shard.RUnlock()
+		cp.shards[index] = items
+	}
+	return cp
+}
+
+// DiffStream compares the map with baseline one shard at a time and sends
+// a Patch for every shard that changed, so the whole diff never has to be
+// held in memory. Values are compared with reflect.DeepEqual. A nil
+// baseline is treated as an empty map. The channel is closed once every
+// shard has been visited or ctx is done.
+func (m *ConcurrentMap[V]) DiffStream(ctx context.Context, baseline *Checkpoint[V]) <-chan Patch[V] {
+	m.lazyInit()
+	base := m.baselineShards(baseline)
+	ch := make(chan Patch[V])
+	go func() {
+		defer close(ch)
+		for index, shard := range m.shards {
+			if ctx.Err() != nil {
+				return
+			}
+			old := base[index]
+			patch := Patch[V]{Shard: index, Set: make(map[string]V)}
+			shard.rlock()
+			for key, val := range shard.items {
+				if prev, ok := old[key]; !ok || !reflect.DeepEqual(prev, val) {
+					patch.Set[key] = val
+				}
+			}
+			for key := range old {
+				if _, ok := shard.items[key]; !ok {
+					patch.Removed = append(patch.Removed, key)
+				}
+			}
+			shard.RUnlock()
+			if len(patch.Set) == 0 && len(patch.Removed) == 0 {
+				continue
+			}
+			select {
+			case ch <- patch:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// baselineShards returns the contents of baseline laid out like the shards
+// of m. Checkpoints of other maps may be sharded differently and are
+// regrouped.
+func (m *ConcurrentMap[V]) baselineShards(baseline *Checkpoint[V]) []map[string]V {
+	if baseline != nil && baseline.m == m {
+		return baseline.shards
+	}
+	shards := make([]map[string]V, m.shardCount)
+	for i := range shards {
+		shards[i] = make(map[string]V)
+	}
+	if baseline == nil {
+		return shards
+	}
+	for _, items := range baseline.shards {
+		for key, val := range items {
+			shards[m.shardIndex(key)][key] = val
+		}
+	}
+	return shards
+}
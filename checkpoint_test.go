@@ -0,0 +1,86 @@
+package cmap
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestDiffStream(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	cp := m.Checkpoint()
+
+	m.Set("1", 100)
+	m.Set("new", 7)
+	m.Remove("2")
+	m.Set("3", 3) // unchanged value
+
+	set := make(map[string]int)
+	var removed []string
+	for patch := range m.DiffStream(context.Background(), cp) {
+		for key, val := range patch.Set {
+			if m.ShardOf(key) != patch.Shard {
+				t.Errorf("key %q reported in shard %d", key, patch.Shard)
+			}
+			set[key] = val
+		}
+		removed = append(removed, patch.Removed...)
+	}
+	if len(set) != 2 || set["1"] != 100 || set["new"] != 7 {
+		t.Errorf("unexpected set keys %v", set)
+	}
+	if len(removed) != 1 || removed[0] != "2" {
+		t.Errorf("unexpected removed keys %v", removed)
+	}
+}
+
+func TestDiffStreamAcrossMaps(t *testing.T) {
+	src := New[int](WithShardCount[int](4))
+	src.MSet(map[string]int{"a": 1, "b": 2})
+	cp := src.Checkpoint()
+
+	dst := New[int]()
+	dst.MSet(map[string]int{"a": 1, "c": 3})
+
+	var set, removed []string
+	for patch := range dst.DiffStream(context.Background(), cp) {
+		for key := range patch.Set {
+			set = append(set, key)
+		}
+		removed = append(removed, patch.Removed...)
+	}
+	if len(set) != 1 || set[0] != "c" {
+		t.Errorf("unexpected set keys %v", set)
+	}
+	if len(removed) != 1 || removed[0] != "b" {
+		t.Errorf("unexpected removed keys %v", removed)
+	}
+
+	var all []string
+	for patch := range dst.DiffStream(context.Background(), nil) {
+		for key := range patch.Set {
+			all = append(all, key)
+		}
+	}
+	sort.Strings(all)
+	if len(all) != 2 || all[0] != "a" || all[1] != "c" {
+		t.Errorf("a nil baseline should report every key, got %v", all)
+	}
+}
+
+func TestDiffStreamCancel(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := m.DiffStream(ctx, nil)
+	<-ch
+	cancel()
+	for range ch {
+	}
+}
@@ -1,8 +1,26 @@
 package cmap
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/maphash"
+	"io"
+	"iter"
+	"maps"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 const SHARD_COUNT = 128
@@ -13,27 +31,294 @@ type ConcurrentMap[V any] struct {
 	shardCount int
 	shards     []*ConcurrentMapShared[V]
 	sharding   func(key string) uint64
+
+	// id orders lock acquisition when an operation spans two maps.
+	id uint64
+	// name labels the map in messages, see NewTyped.
+	name string
+	// onces guards SetOnce, it holds one sync.Once per key ever passed to it.
+	onces *ConcurrentMap[*sync.Once]
+	// count is the number of items across all shards, maintained by every
+	// write under the lock of the modified shard.
+	count atomic.Int64
+	// frozen is set by Freeze, the shards are immutable from then on and
+	// are read without locking.
+	frozen atomic.Bool
+	// emptyMu guards emptyWaiters, the channels handed out by NotifyOnEmpty.
+	emptyMu      sync.Mutex
+	emptyWaiters []chan struct{}
+	// maxSize is the capacity set by WithMaxSize, 0 if unset. full is
+	// closed by fullOnce the first time the count reaches it.
+	maxSize  int64
+	full     chan struct{}
+	fullOnce sync.Once
+	// onEvict is called for the items evicted to stay within maxSize.
+	onEvict func(key string, v V)
+
+	initialData map[string]V
+	// shardCapacity is the size hint of the shards' maps.
+	shardCapacity int
+	metrics       *mapMetrics
+	// debug makes the shards collect lock statistics, see WithDebug.
+	debug bool
+	// sequential makes snapshots and Keys visit shards one after the other
+	// instead of spawning a goroutine per shard.
+	sequential bool
+	// keyTransform normalizes every key before it is used, if set.
+	keyTransform func(key string) string
+	// keyValidator rejects invalid keys on writes, if set.
+	keyValidator func(key string) error
+	// lockTracer is told how long writes held their shard lock, if set.
+	lockTracer func(op string, key string, held time.Duration)
+	// yieldAfterWrite makes writes yield the processor once unlocked.
+	yieldAfterWrite bool
+	// mutationLog is told about the writes, if set.
+	mutationLog MutationLogger[V]
+	// streams are the open change streams, see ChangeStream.
+	streams      changeStreams[V]
+	streamBuffer int
+	// cloneOpts are the options given to New, retained for Clone when
+	// WithCloneOptions is set.
+	cloneOpts     []Option[V]
+	keepCloneOpts bool
+	// err is the first invalid option met by New.
+	err error
+	// rnd is the random source of Sample, guarded by rndMu since
+	// rand.Rand is not safe for concurrent use.
+	rnd   *rand.Rand
+	rndMu *sync.Mutex
+
+	// initOnce guards the initialization of the map, either in New or
+	// lazily on first use of a zero value map.
+	initOnce sync.Once
+
+	life *lifecycle
+	// background goroutines requested by options, started once New has
+	// built the map. They must return once life.done is closed.
+	background []func()
+}
+
+// lifecycle tracks whether a map has been disposed.
+type lifecycle struct {
+	// done is closed by Dispose, background goroutines started by options
+	// must return once it is closed.
+	done     chan struct{}
+	once     sync.Once
+	disposed atomic.Bool
+}
+
+// MapMetrics is a point in time copy of the operation counters of a map
+// created with WithMetrics.
+type MapMetrics struct {
+	Name    string // Name given to NewTyped, empty for anonymous maps.
+	Hits    int64  // Get calls that found the key.
+	Misses  int64  // Get calls that did not find the key.
+	Sets    int64  // Set calls.
+	Removes int64  // Remove calls.
+}
+
+// ShardStats is a point in time copy of the lock statistics of a shard of
+// a map created with WithDebug. Wait times are the nanoseconds spent
+// acquiring the shard's lock, ops the number of acquisitions and contended
+// the number of those that found the lock taken and had to wait.
+type ShardStats struct {
+	ReadLockWaitNs, WriteLockWaitNs uint64
+	ReadOps, WriteOps               uint64
+	ReadContended, WriteContended   uint64
+}
+
+type shardStats struct {
+	readWaitNs, writeWaitNs       atomic.Uint64
+	readOps, writeOps             atomic.Uint64
+	readContended, writeContended atomic.Uint64
+}
+
+type mapMetrics struct {
+	hits    atomic.Int64
+	misses  atomic.Int64
+	sets    atomic.Int64
+	removes atomic.Int64
 }
 
 // A "thread" safe string to anything map.
 type ConcurrentMapShared[V any] struct {
 	items        map[string]V
 	sync.RWMutex // Read Write mutex, guards access to internal map.
+	// stats collects lock statistics, it is nil unless WithDebug is given.
+	stats *shardStats
 }
 
-type Option[V any] func(*ConcurrentMap[V])
+// newShard creates an empty shard with room for capacity items.
+func newShard[V any](capacity int) *ConcurrentMapShared[V] {
+	return &ConcurrentMapShared[V]{items: make(map[string]V, capacity)}
+}
 
-func WithShardCount[V any](shardCount int) Option[V] {
-	if shardCount <= 0 {
-		panic("shardCount must be greater than 0")
+// ForEach calls fn for every item of the shard while holding its read lock.
+// fn MUST NOT write to the shard, as that would deadlock.
+func (s *ConcurrentMapShared[V]) ForEach(fn func(key string, v V)) {
+	s.rlock()
+	defer s.RUnlock()
+	for key, value := range s.items {
+		fn(key, value)
+	}
+}
+
+// LockedShard is a standalone shard, an RWMutex guarded map for data
+// structures that need the locking pattern of a single shard without the
+// sharding overhead. Unlike the shards of a ConcurrentMap, it has no map
+// bookkeeping to keep up and can be written to directly.
+type LockedShard[V any] struct {
+	shard *ConcurrentMapShared[V]
+}
+
+// NewLockedShard creates a standalone shard with room for capacity items.
+func NewLockedShard[V any](capacity int) *LockedShard[V] {
+	return &LockedShard[V]{shard: newShard[V](capacity)}
+}
+
+// Get returns the value of key in the shard, under its read lock.
+func (s *LockedShard[V]) Get(key string) (V, bool) {
+	s.shard.rlock()
+	defer s.shard.RUnlock()
+	v, ok := s.shard.items[key]
+	return v, ok
+}
+
+// Set sets key to value in the shard, under its write lock.
+func (s *LockedShard[V]) Set(key string, value V) {
+	s.shard.lock()
+	defer s.shard.Unlock()
+	s.shard.items[key] = value
+}
+
+// Remove deletes key from the shard, under its write lock, and returns the
+// value it held, if any.
+func (s *LockedShard[V]) Remove(key string) (V, bool) {
+	s.shard.lock()
+	defer s.shard.Unlock()
+	return s.shard.remove(key)
+}
+
+// ForEach calls fn for every item of the shard while holding its read lock.
+// fn MUST NOT write to the shard, as that would deadlock.
+func (s *LockedShard[V]) ForEach(fn func(key string, v V)) {
+	s.shard.ForEach(fn)
+}
+
+// Len returns the number of items within the shard.
+func (s *LockedShard[V]) Len() int {
+	return s.shard.Len()
+}
+
+// store sets key to value and reports whether key was absent.
+// The caller must hold the write lock.
+func (s *ConcurrentMapShared[V]) store(key string, value V) bool {
+	_, ok := s.items[key]
+	s.items[key] = value
+	return !ok
+}
+
+// remove deletes key and returns the value it held, if any.
+// The caller must hold the write lock.
+func (s *ConcurrentMapShared[V]) remove(key string) (V, bool) {
+	v, ok := s.items[key]
+	if ok {
+		delete(s.items, key)
+	}
+	return v, ok
+}
+
+// lock is Lock, timed when the shard collects statistics.
+func (s *ConcurrentMapShared[V]) lock() {
+	if s.stats == nil {
+		s.Lock()
+		return
+	}
+	start := time.Now()
+	if !s.TryLock() {
+		s.stats.writeContended.Add(1)
+		s.Lock()
+	}
+	s.stats.writeWaitNs.Add(uint64(time.Since(start)))
+	s.stats.writeOps.Add(1)
+}
+
+// rlock is RLock, timed when the shard collects statistics.
+func (s *ConcurrentMapShared[V]) rlock() {
+	if s.stats == nil {
+		s.RLock()
+		return
 	}
-	if shardCount&(shardCount-1) != 0 {
-		panic("shardCount must be a power of 2")
+	start := time.Now()
+	if !s.TryRLock() {
+		s.stats.readContended.Add(1)
+		s.RLock()
 	}
+	s.stats.readWaitNs.Add(uint64(time.Since(start)))
+	s.stats.readOps.Add(1)
+}
+
+// Len returns the number of items within the shard.
+func (s *ConcurrentMapShared[V]) Len() int {
+	s.rlock()
+	defer s.RUnlock()
+	return len(s.items)
+}
 
+type Option[V any] func(*ConcurrentMap[V])
+
+// Errors reported by NewWithError for invalid options.
+var (
+	ErrShardCountNotPositive = errors.New("cmap: shardCount must be greater than 0")
+	ErrMaxSizeNotPositive    = errors.New("cmap: maxSize must be greater than 0")
+	ErrCapacityNegative      = errors.New("cmap: capacity must not be negative")
+)
+
+// WithShardCount sets the number of shards, which must be positive.
+// Keys are assigned to shards by modulo, so any count works, powers of 2
+// are not required. Invalid counts make New panic and NewWithError fail.
+func WithShardCount[V any](shardCount int) Option[V] {
 	return func(cm *ConcurrentMap[V]) {
+		if shardCount <= 0 {
+			cm.setErr(ErrShardCountNotPositive)
+			return
+		}
 		cm.shardCount = shardCount
-		cm.shards = make([]*ConcurrentMapShared[V], shardCount)
+	}
+}
+
+// ErrDisposed is returned, or wrapped, by writes to a disposed map.
+var ErrDisposed = errors.New("cmap: write to disposed ConcurrentMap")
+
+// ErrMapFull is returned, or wrapped, by Set and Upsert when inserting a
+// new key in a map holding the size set by WithMaxSize.
+var ErrMapFull = errors.New("cmap: map is full")
+
+// ErrLockTimeout is returned by TryGet when the shard lock could not be
+// acquired in time.
+var ErrLockTimeout = errors.New("cmap: shard lock timeout")
+
+// FreezeError is returned, or panicked with, by writes to a frozen map.
+type FreezeError struct {
+	// Name is the name of the map, see NewTyped.
+	Name string
+}
+
+func (e *FreezeError) Error() string {
+	if e.Name != "" {
+		return fmt.Sprintf("cmap: write to frozen ConcurrentMap (map %q)", e.Name)
+	}
+	return "cmap: write to frozen ConcurrentMap"
+}
+
+// ErrInvalidKey is wrapped by the errors, and panics, caused by keys
+// rejected by the validator set with WithKeyValidator.
+var ErrInvalidKey = errors.New("cmap: invalid key")
+
+// setErr records the first configuration error met while applying options.
+func (m *ConcurrentMap[V]) setErr(err error) {
+	if m.err == nil {
+		m.err = err
 	}
 }
 
@@ -43,309 +328,2567 @@ func WithShardingFunction[V any](sharding func(key string) uint64) Option[V] {
 	}
 }
 
-// Creates a new concurrent map.
+// WithHasher shards keys using the hashes produced by factory, for example
+// fnv.New64a or an xxhash constructor. Hashers are pooled and reset between
+// keys, yet going through the hash.Hash64 interface still costs a key copy
+// per call, use WithShardingFunction when hashing is on a hot path.
+func WithHasher[V any](factory func() hash.Hash64) Option[V] {
+	pool := sync.Pool{New: func() any { return factory() }}
+	return WithShardingFunction[V](func(key string) uint64 {
+		h := pool.Get().(hash.Hash64)
+		h.Reset()
+		h.Write([]byte(key))
+		sum := h.Sum64()
+		pool.Put(h)
+		return sum
+	})
+}
+
+// WithModuloSharding shards keys by their first byte: a key starting with
+// byte b lives in shard b % shardCount, the empty key in shard 0. It is a
+// testing aid, keys landing in a given shard are easy to build, for
+// example "\x03..." for shard 3, but it spreads real keys poorly.
+func WithModuloSharding[V any]() Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.sharding = func(key string) uint64 {
+			if key == "" {
+				return 0
+			}
+			return uint64(key[0])
+		}
+	}
+}
+
+// WithSeededHasher shards keys with hash/maphash using a random seed chosen
+// for each map, so shard assignment cannot be predicted from outside the
+// process. Prefer it over the default fnv64a when keys come from untrusted
+// input: with a known hash function an attacker can pick keys that all land
+// in one shard and serialize every operation on a single lock.
+func WithSeededHasher[V any]() Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		seed := maphash.MakeSeed()
+		cm.sharding = func(key string) uint64 {
+			return maphash.String(seed, key)
+		}
+	}
+}
+
+// WithKeyTransformer normalizes every key with fn before it is used for
+// sharding or storage, for example with strings.ToLower to get a case
+// insensitive map. fn must be idempotent, as in fn(fn(k)) == fn(k), since
+// operations built on top of others may apply it more than once.
+func WithKeyTransformer[V any](fn func(key string) string) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.keyTransform = fn
+	}
+}
+
+// WithKeyValidator makes every write check its keys with fn, after the
+// transformer of WithKeyTransformer has been applied. Methods that return
+// an error (Set, Upsert, Transact, NewWithError for WithInitialData and the
+// unmarshalers) report rejected keys through it, the other writes panic.
+// Either way the error wraps both ErrInvalidKey and the error of fn, and
+// batch writes such as MSet store nothing if any of their keys is rejected.
+func WithKeyValidator[V any](fn func(key string) error) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.keyValidator = fn
+	}
+}
+
+// WithLockTracer calls fn after each locked section of the single key
+// writes (Set, SetIfAbsent, Upsert, Remove, RemoveAndCheckEmpty, RemoveCb
+// and Pop, and MSet once per key) with the name of the method, the key and
+// how long the shard's write lock was held. fn is called after the lock is
+// released, concurrently from all writers. Maps without a tracer do not
+// read the clock.
+func WithLockTracer[V any](fn func(op string, key string, held time.Duration)) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.lockTracer = fn
+	}
+}
+
+// WithSyncAfterWrite makes the single key writes (Set, SetIfAbsent,
+// Upsert, Remove, RemoveAndCheckEmpty, RemoveCb and Pop, and MSet once per
+// key) call runtime.Gosched once they released their shard lock, handing
+// the processor to the readers they blocked. It trades write throughput
+// for read latency in read heavy workloads.
+func WithSyncAfterWrite[V any]() Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.yieldAfterWrite = true
+	}
+}
+
+// WithSequentialIteration makes IterBuffered, Items, Keys and PopAll walk
+// the shards one after the other from the calling goroutine, instead of
+// spawning a goroutine per shard. For small maps this is faster, the
+// goroutines cost more than they save.
+func WithSequentialIteration[V any]() Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.sequential = true
+	}
+}
+
+// WithMaxSize caps the number of items of the map: once Count reaches max,
+// Set and Upsert fail with ErrMapFull for new keys, updates of existing
+// keys still succeed, and BatchUpsert and BatchUpsertKeys skip new keys.
+// With WithOnEvict an item is evicted instead. The count is an atomic
+// counter checked under the lock of the written shard only, so concurrent
+// inserts in different shards may slightly exceed max; the other writes,
+// such as MSet or SetIfAbsent, are not bounded.
+// The channel returned by NotifyOnFull is closed the first time Count
+// reaches max. Non positive sizes make New panic and NewWithError fail.
+func WithMaxSize[V any](max int) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		if max <= 0 {
+			cm.setErr(ErrMaxSizeNotPositive)
+			return
+		}
+		cm.maxSize = int64(max)
+		cm.full = make(chan struct{})
+	}
+}
+
+// WithCapacityPerShard preallocates room for capacity items in every
+// shard, and again when PopAll empties them, so maps with a known steady
+// state size do not grow their shards incrementally. Negative capacities
+// make New panic and NewWithError fail.
+func WithCapacityPerShard[V any](capacity int) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		if capacity < 0 {
+			cm.setErr(ErrCapacityNegative)
+			return
+		}
+		cm.shardCapacity = capacity
+	}
+}
+
+// WithOnEvict makes the map evict an item whenever a write inserts a new
+// key while the map holds the size set by WithMaxSize. This covers the
+// single key writes, the batch ones such as MSetCount, BatchUpsert or
+// SetBulkFromChannel, transactions and Undo; only the raw items written
+// through WithShardWrite and LockShard are exempt. A transaction or batch
+// may evict keys it wrote itself.
+//
+// The evicted item is an arbitrary one of the shard receiving the new key,
+// so that everything happens under that shard's lock, in this order: the
+// evicted key is removed from the shard, fn is called with it, and only
+// then is the new key inserted. fn thus never sees both keys at once, and
+// the new value is not visible before fn returns. fn MUST NOT access the
+// map. If the shard is empty nothing is evicted and the map grows past its
+// size, which is approximate anyway since concurrent writes to different
+// shards race.
+func WithOnEvict[V any](fn func(key string, v V)) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.onEvict = fn
+	}
+}
+
+// WithDebug makes every shard record how long its lock acquisitions wait,
+// as reported by GetShardStats. It adds two clock reads per lock.
+func WithDebug[V any]() Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.debug = true
+	}
+}
+
+// WithMetrics enables the operation counters reported by Metrics.
+// Maps created without it do not pay for the bookkeeping.
+func WithMetrics[V any]() Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.metrics = &mapMetrics{}
+	}
+}
+
+// WithAutoDispose disposes the map as soon as ctx is cancelled.
+func WithAutoDispose[V any](ctx context.Context) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.background = append(cm.background, func() {
+			select {
+			case <-ctx.Done():
+				cm.Dispose()
+			case <-cm.life.done:
+			}
+		})
+	}
+}
+
+// WithCloneOptions makes the map remember all the options it was created
+// with, so that Clone applies them again to the copy. Without it, Clone only
+// preserves the shard count and the sharding function.
+// The options are retained for the lifetime of the map, including any data
+// given to WithInitialData.
+func WithCloneOptions[V any]() Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.keepCloneOpts = true
+	}
+}
+
+// WithRandSource makes Sample draw from r instead of the global random
+// source, which allows reproducible samples in tests: with a configured
+// source, the keys of each shard are sampled in sorted order.
+func WithRandSource[V any](r *rand.Rand) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.rnd = r
+		cm.rndMu = &sync.Mutex{}
+	}
+}
+
+// WithInitialData populates the map with data while it is being constructed.
+// Entries are written straight into the shards, without taking any locks.
+// The map does not retain data, later changes to it are not reflected.
+func WithInitialData[V any](data map[string]V) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.initialData = data
+	}
+}
+
+// mapIDs hands out the ids of newly created maps.
+var mapIDs atomic.Uint64
+
+// Creates a new concurrent map. It panics if an option is invalid.
+//
+// A zero value ConcurrentMap is ready to use as well, it is initialized
+// with the default options on first use.
 func New[V any](opts ...Option[V]) *ConcurrentMap[V] {
-	m := &ConcurrentMap[V]{
-		shardCount: SHARD_COUNT,
-		sharding:   fnv64a,
-		shards:     make([]*ConcurrentMapShared[V], SHARD_COUNT),
+	m, err := NewWithError(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// NewTyped creates a new concurrent map labelled with typeName, which is
+// included in its panic and error messages, its metrics and its String
+// output, telling apart the maps of applications holding many of them.
+func NewTyped[V any](typeName string, opts ...Option[V]) *ConcurrentMap[V] {
+	return New(append([]Option[V]{func(cm *ConcurrentMap[V]) { cm.name = typeName }}, opts...)...)
+}
+
+// NewWithError creates a new concurrent map like New, but reports invalid
+// options as an error instead of panicking.
+func NewWithError[V any](opts ...Option[V]) (*ConcurrentMap[V], error) {
+	m := &ConcurrentMap[V]{}
+	var err error
+	m.initOnce.Do(func() { err = m.init(opts) })
+	if err != nil {
+		return nil, err
 	}
+	return m, nil
+}
+
+// lazyInit initializes a zero value map with the default options.
+// Every method accessing the shards directly must call it first.
+func (m *ConcurrentMap[V]) lazyInit() {
+	m.initOnce.Do(func() { m.init(nil) })
+}
+
+// init applies opts on top of the defaults and allocates the shards.
+func (m *ConcurrentMap[V]) init(opts []Option[V]) error {
+	m.shardCount = SHARD_COUNT
+	m.sharding = fnv64a
+	m.id = mapIDs.Add(1)
+	m.life = &lifecycle{done: make(chan struct{})}
+	m.onces = &ConcurrentMap[*sync.Once]{}
 	for _, opt := range opts {
 		opt(m)
 	}
+	if m.err != nil {
+		if m.name != "" {
+			return fmt.Errorf("%w (map %q)", m.err, m.name)
+		}
+		return m.err
+	}
+	if m.keepCloneOpts {
+		m.cloneOpts = opts
+	}
 
+	m.shards = make([]*ConcurrentMapShared[V], m.shardCount)
 	for i := 0; i < m.shardCount; i++ {
-		m.shards[i] = &ConcurrentMapShared[V]{items: make(map[string]V)}
+		m.shards[i] = newShard[V](m.shardCapacity)
+		if m.debug {
+			m.shards[i].stats = &shardStats{}
+		}
+	}
+	for key, value := range m.initialData {
+		key = m.normalize(key)
+		if err := m.validate(key); err != nil {
+			return err
+		}
+		if m.shards[m.shardIndex(key)].store(key, value) {
+			m.addCount(1)
+		}
+	}
+	m.initialData = nil
+	for _, fn := range m.background {
+		go fn()
+	}
+	return nil
+}
+
+// FromMap creates a new concurrent map holding a copy of data.
+// It is a shorthand for New(WithInitialData(data), opts...).
+func FromMap[V any](data map[string]V, opts ...Option[V]) *ConcurrentMap[V] {
+	return New(append([]Option[V]{WithInitialData(data)}, opts...)...)
+}
+
+// ConcurrentMapOptions describes the configuration a map was created with.
+// The functions are the ones given to the options, nil if unset. The
+// context of WithAutoDispose, the source of WithRandSource, the data of
+// WithInitialData and WithCloneOptions are not reported.
+type ConcurrentMapOptions[V any] struct {
+	ShardCount   int
+	ShardingFunc func(key string) uint64
+	Metrics      bool   // Whether WithMetrics was given.
+	Name         string // Name given to NewTyped.
+	MaxSize      int    // Capacity given to WithMaxSize, 0 if unset.
+
+	CapacityPerShard    int  // Hint given to WithCapacityPerShard, 0 if unset.
+	Debug               bool // Whether WithDebug was given.
+	SequentialIteration bool // Whether WithSequentialIteration was given.
+	SyncAfterWrite      bool // Whether WithSyncAfterWrite was given.
+	ChangeStreamBuffer  int  // Size given to WithChangeStreamBuffer, 0 if unset.
+
+	KeyTransformer func(key string) string
+	KeyValidator   func(key string) error
+	OnEvict        func(key string, v V)
+	LockTracer     func(op string, key string, held time.Duration)
+	MutationLog    MutationLogger[V]
+}
+
+// Options returns the configuration of the map.
+func (m *ConcurrentMap[V]) Options() ConcurrentMapOptions[V] {
+	m.lazyInit()
+	return ConcurrentMapOptions[V]{
+		ShardCount:   m.shardCount,
+		ShardingFunc: m.sharding,
+		Metrics:      m.metrics != nil,
+		Name:         m.name,
+		MaxSize:      int(m.maxSize),
+
+		CapacityPerShard:    m.shardCapacity,
+		Debug:               m.debug,
+		SequentialIteration: m.sequential,
+		SyncAfterWrite:      m.yieldAfterWrite,
+		ChangeStreamBuffer:  m.streamBuffer,
+
+		KeyTransformer: m.keyTransform,
+		KeyValidator:   m.keyValidator,
+		OnEvict:        m.onEvict,
+		LockTracer:     m.lockTracer,
+		MutationLog:    m.mutationLog,
+	}
+}
+
+// Clone returns an independent copy of the map. The copy is created with the
+// options recorded by WithCloneOptions, or with the same shard count, key
+// transformer and key validator otherwise, and always shards keys like the
+// original. Each shard is copied under its read lock.
+func (m *ConcurrentMap[V]) Clone() *ConcurrentMap[V] {
+	m.lazyInit()
+	var c *ConcurrentMap[V]
+	if m.keepCloneOpts {
+		c = New(m.cloneOpts...)
+	} else {
+		c = m.derived()
+	}
+	// Share the sharding function, seeded hashers would otherwise assign
+	// keys to other shards than in the original.
+	c.sharding = m.sharding
+	for i, shard := range m.shards {
+		shard.rlock()
+		items := make(map[string]V, len(shard.items))
+		for key, val := range shard.items {
+			items[key] = val
+		}
+		shard.RUnlock()
+
+		c.shards[i].lock()
+		c.addCount(int64(len(items) - len(c.shards[i].items)))
+		c.shards[i].items = items
+		c.shards[i].Unlock()
+	}
+	return c
+}
+
+// Pipeline calls every fn with m, in order, and returns m, so setup steps
+// can be chained: New[int]().Pipeline(load, applyDefaults, warmCache).
+func (m *ConcurrentMap[V]) Pipeline(fns ...func(*ConcurrentMap[V])) *ConcurrentMap[V] {
+	for _, fn := range fns {
+		fn(m)
 	}
 	return m
 }
 
-// GetShard returns shard under given key
-func (m ConcurrentMap[V]) GetShard(key string) *ConcurrentMapShared[V] {
-	return m.shards[uint(m.sharding(key))%uint(m.shardCount)]
+// derived returns an empty map with the shard count, sharding and key
+// normalization of m, whose shards can take the keys of the shards of m at
+// the same index as they are.
+func (m *ConcurrentMap[V]) derived() *ConcurrentMap[V] {
+	c := New(WithShardCount[V](m.shardCount))
+	c.sharding = m.sharding
+	c.keyTransform = m.keyTransform
+	c.keyValidator = m.keyValidator
+	return c
 }
 
-func (m ConcurrentMap[V]) MSet(data map[string]V) {
-	for key, value := range data {
-		shard := m.GetShard(key)
-		shard.Lock()
-		shard.items[key] = value
+// Snapshot returns a copy of the map taken while the read locks of all
+// shards are held at once, so unlike Clone or Items it is a consistent
+// view of a single moment across shards. Locks are taken in index order.
+// Writers are blocked for the whole copy, use it for backups only.
+// The copy has the same shard count, sharding, key transformer and key
+// validator as the original.
+func (m *ConcurrentMap[V]) Snapshot() *ConcurrentMap[V] {
+	m.lazyInit()
+	c := m.derived()
+	for _, shard := range m.shards {
+		shard.rlock()
+	}
+	for i, shard := range m.shards {
+		items := make(map[string]V, len(shard.items))
+		for key, val := range shard.items {
+			items[key] = val
+		}
+		c.shards[i].items = items
+		c.addCount(int64(len(items)))
+	}
+	for i := len(m.shards) - 1; i >= 0; i-- {
+		m.shards[i].RUnlock()
+	}
+	return c
+}
+
+// CopyTo sets every item of m into dst, overwriting the keys dst already
+// has. Each shard of m is copied under its read lock, which is released
+// before writing to dst, so m and dst can safely copy into each other
+// concurrently. It stops at the first error of dst.Set.
+func (m *ConcurrentMap[V]) CopyTo(dst *ConcurrentMap[V]) error {
+	m.lazyInit()
+	for _, shard := range m.shards {
+		shard.rlock()
+		tuples := make([]Tuple[V], 0, len(shard.items))
+		for key, val := range shard.items {
+			tuples = append(tuples, Tuple[V]{key, val})
+		}
+		shard.RUnlock()
+
+		for _, t := range tuples {
+			if err := dst.Set(t.Key, t.Val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Dispose stops every background goroutine started by the map's options,
+// closes its change streams and releases all items. Calling Dispose more
+// than once is a no-op.
+//
+// Once Dispose has returned, read operations behave as on an empty map
+// and write operations panic. Frozen maps are immutable and keep their
+// items, only their background goroutines are stopped.
+func (m *ConcurrentMap[V]) Dispose() {
+	m.lazyInit()
+	m.life.once.Do(func() {
+		m.life.disposed.Store(true)
+		close(m.life.done)
+		m.closeStreams()
+		if m.frozen.Load() {
+			// Frozen shards are read without locks and must not be cleared.
+			return
+		}
+		for _, shard := range m.shards {
+			shard.lock()
+			if m.frozen.Load() {
+				// Frozen meanwhile.
+				shard.Unlock()
+				return
+			}
+			m.addCount(-int64(len(shard.items)))
+			shard.items = make(map[string]V)
+			shard.Unlock()
+		}
+	})
+}
+
+// Freeze seals the map once its build phase is over: from then on writes
+// fail with a *FreezeError, the methods that cannot return an error panic
+// with it, and Get, Has and Keys read the shards without locking them.
+// Writes racing with Freeze are either applied before it returns or fail;
+// those spanning several shards, such as PopIf, may fail after updating
+// some of them. Calling Freeze more than once is a no-op; a frozen map
+// cannot be thawed, Clone it instead.
+func (m *ConcurrentMap[V]) Freeze() {
+	m.lazyInit()
+	// Holding every lock while the flag flips orders all previous writes
+	// before the lock free reads.
+	for _, shard := range m.shards {
+		shard.lock()
+	}
+	m.frozen.Store(true)
+	for _, shard := range m.shards {
 		shard.Unlock()
 	}
 }
 
-// Sets the given value under the specified key.
-func (m ConcurrentMap[V]) Set(key string, value V) {
-	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	shard.items[key] = value
-	shard.Unlock()
+// IsFrozen reports whether Freeze has been called on the map.
+func (m *ConcurrentMap[V]) IsFrozen() bool {
+	return m.frozen.Load()
 }
 
-// Callback to return new element to be inserted into the map
-// It is called while lock is held, therefore it MUST NOT
-// try to access other keys in same map, as it can lead to deadlock since
-// Go sync.RWLock is not reentrant
-type UpsertCb[V any] func(exist bool, valueInMap V, newValue V) V
+// IsDisposed reports whether Dispose has been called on the map.
+func (m *ConcurrentMap[V]) IsDisposed() bool {
+	m.lazyInit()
+	return m.life.disposed.Load()
+}
 
-// Insert or Update - updates existing element or inserts a new one using UpsertCb
-func (m ConcurrentMap[V]) Upsert(key string, value V, cb UpsertCb[V]) (res V) {
-	shard := m.GetShard(key)
-	shard.Lock()
-	v, ok := shard.items[key]
-	res = cb(ok, v, value)
-	shard.items[key] = res
-	shard.Unlock()
-	return res
+// prefix returns the prefix of the map's messages, cmap(name) for maps
+// created with NewTyped and cmap otherwise.
+func (m *ConcurrentMap[V]) prefix() string {
+	if m.name == "" {
+		return "cmap"
+	}
+	return "cmap(" + m.name + ")"
 }
 
-// Sets the given value under the specified key if no value was associated with it.
-func (m ConcurrentMap[V]) SetIfAbsent(key string, value V) bool {
-	// Get map shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	_, ok := shard.items[key]
-	if !ok {
-		shard.items[key] = value
+// writeErr returns an error wrapping ErrDisposed if the map has been
+// disposed, or a *FreezeError if it has been frozen. It guards the writes
+// that return an error.
+func (m *ConcurrentMap[V]) writeErr() error {
+	m.lazyInit()
+	if m.frozen.Load() {
+		return &FreezeError{Name: m.name}
 	}
-	shard.Unlock()
-	return !ok
+	if !m.life.disposed.Load() {
+		return nil
+	}
+	if m.name != "" {
+		return fmt.Errorf("%w (map %q)", ErrDisposed, m.name)
+	}
+	return ErrDisposed
 }
 
-// Get retrieves an element from map under given key.
-func (m ConcurrentMap[V]) Get(key string) (V, bool) {
-	// Get shard
-	shard := m.GetShard(key)
-	shard.RLock()
-	// Get item from shard.
-	val, ok := shard.items[key]
-	shard.RUnlock()
-	return val, ok
+// lockWrite takes the write lock of shard for a write and checks writeErr
+// again once it holds it: a writer waiting for the lock while Freeze held
+// it would otherwise write to a frozen map, whose shards are read without
+// locking. On error the lock is released.
+func (m *ConcurrentMap[V]) lockWrite(shard *ConcurrentMapShared[V]) error {
+	shard.lock()
+	if err := m.writeErr(); err != nil {
+		shard.Unlock()
+		return err
+	}
+	return nil
 }
 
-// Count returns the number of elements within the map.
-func (m ConcurrentMap[V]) Count() int {
-	count := 0
-	for i := 0; i < m.shardCount; i++ {
-		shard := m.shards[i]
-		shard.RLock()
-		count += len(shard.items)
-		shard.RUnlock()
+// mustLockWrite is lockWrite for the writes that cannot return an error,
+// it panics instead.
+func (m *ConcurrentMap[V]) mustLockWrite(shard *ConcurrentMapShared[V]) {
+	if err := m.lockWrite(shard); err != nil {
+		panic(err)
 	}
-	return count
 }
 
-// Looks up an item under specified key
-func (m ConcurrentMap[V]) Has(key string) bool {
-	// Get shard
-	shard := m.GetShard(key)
-	shard.RLock()
-	// See if element is within shard.
-	_, ok := shard.items[key]
-	shard.RUnlock()
-	return ok
+// checkWrite panics if the map has been disposed or frozen, it guards the
+// writes that cannot return an error.
+func (m *ConcurrentMap[V]) checkWrite() {
+	if err := m.writeErr(); err != nil {
+		panic(err)
+	}
+}
+
+// GetShard returns shard under given key
+func (m *ConcurrentMap[V]) GetShard(key string) *ConcurrentMapShared[V] {
+	return m.getShard(m.normalize(key))
+}
+
+// getShard returns the shard of an already normalized key.
+func (m *ConcurrentMap[V]) getShard(key string) *ConcurrentMapShared[V] {
+	m.lazyInit()
+	return m.shards[m.shardIndex(key)]
+}
+
+// normalize applies the transformer set by WithKeyTransformer to key.
+func (m *ConcurrentMap[V]) normalize(key string) string {
+	if m.keyTransform == nil {
+		return key
+	}
+	return m.keyTransform(key)
+}
+
+// validate checks an already normalized key with the validator set by
+// WithKeyValidator.
+func (m *ConcurrentMap[V]) validate(key string) error {
+	if m.keyValidator == nil {
+		return nil
+	}
+	err := m.keyValidator(key)
+	if err == nil {
+		return nil
+	}
+	if m.name != "" {
+		return fmt.Errorf("%w %q (map %q): %w", ErrInvalidKey, key, m.name, err)
+	}
+	return fmt.Errorf("%w %q: %w", ErrInvalidKey, key, err)
+}
+
+// mustValidate is validate for writes that cannot return an error.
+func (m *ConcurrentMap[V]) mustValidate(key string) {
+	if err := m.validate(key); err != nil {
+		panic(err)
+	}
+}
+
+// traceStart returns the start of a locked section for afterWrite, the
+// zero time if no tracer is set.
+func (m *ConcurrentMap[V]) traceStart() time.Time {
+	if m.lockTracer == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// afterWrite runs once a single key write released its shard lock: it
+// reports the locked section started at start to the tracer set by
+// WithLockTracer, and yields if WithSyncAfterWrite is set.
+func (m *ConcurrentMap[V]) afterWrite(op, key string, start time.Time) {
+	if m.lockTracer != nil {
+		m.lockTracer(op, key, time.Since(start))
+	}
+	if m.yieldAfterWrite {
+		runtime.Gosched()
+	}
+}
+
+// shardIndex returns the index of the shard responsible for the given key.
+func (m *ConcurrentMap[V]) shardIndex(key string) uint {
+	return uint(m.sharding(key)) % uint(m.shardCount)
+}
+
+// ShardOf returns the index of the shard holding key.
+func (m *ConcurrentMap[V]) ShardOf(key string) int {
+	m.lazyInit()
+	return int(m.shardIndex(m.normalize(key)))
+}
+
+// GetShardStats returns the lock statistics of every shard, indexed like
+// ShardOf. They are all zero unless the map was created with WithDebug.
+func (m *ConcurrentMap[V]) GetShardStats() []ShardStats {
+	m.lazyInit()
+	stats := make([]ShardStats, m.shardCount)
+	for i, shard := range m.shards {
+		if shard.stats == nil {
+			continue
+		}
+		stats[i] = ShardStats{
+			ReadLockWaitNs:  shard.stats.readWaitNs.Load(),
+			WriteLockWaitNs: shard.stats.writeWaitNs.Load(),
+			ReadOps:         shard.stats.readOps.Load(),
+			WriteOps:        shard.stats.writeOps.Load(),
+			ReadContended:   shard.stats.readContended.Load(),
+			WriteContended:  shard.stats.writeContended.Load(),
+		}
+	}
+	return stats
+}
+
+// LockContention returns the fraction of the shard lock acquisitions, read
+// and write, that had to wait, from 0 when none did to 1 when all did. It
+// is computed from GetShardStats and is thus 0 without WithDebug.
+func (m *ConcurrentMap[V]) LockContention() float64 {
+	var ops, contended uint64
+	for _, s := range m.GetShardStats() {
+		ops += s.ReadOps + s.WriteOps
+		contended += s.ReadContended + s.WriteContended
+	}
+	if ops == 0 {
+		return 0
+	}
+	return float64(contended) / float64(ops)
+}
+
+// shardAt returns the shard at index, it panics if index is out of range.
+func (m *ConcurrentMap[V]) shardAt(index int) *ConcurrentMapShared[V] {
+	m.lazyInit()
+	if index < 0 || index >= m.shardCount {
+		panic(fmt.Sprintf("%s: shard index %d out of range [0, %d)", m.prefix(), index, m.shardCount))
+	}
+	return m.shards[index]
+}
+
+// LockShard takes the write lock of the shard at shardIndex and returns the
+// shard's own items map, for read, compute and conditional write sequences,
+// along with the function releasing the lock, which may safely be called
+// more than once. Like with WithShardWrite, only keys belonging to the
+// shard (see ShardOf) may be added to items, and items MUST NOT be used
+// after unlock, which brings the count and the change streams up to date.
+// Until then every other access to the shard blocks, including the
+// caller's own calls for keys of that shard, which therefore deadlock.
+// It panics if shardIndex is out of range, or the map is disposed or
+// frozen.
+func (m *ConcurrentMap[V]) LockShard(shardIndex int) (items map[string]V, unlock func()) {
+	shard := m.shardAt(shardIndex)
+	m.mustLockWrite(shard)
+	before := len(shard.items)
+	var snapshot map[string]V
+	if m.streaming() {
+		snapshot = maps.Clone(shard.items)
+	}
+	once := sync.Once{}
+	return shard.items, func() {
+		once.Do(func() {
+			m.addCount(int64(len(shard.items) - before))
+			if snapshot != nil {
+				m.emitDiff(snapshot, shard.items)
+			}
+			shard.Unlock()
+		})
+	}
+}
+
+// RLockShard takes the read lock of the shard at shardIndex and returns the
+// shard's own items map, without copying, along with the function releasing
+// the lock, which may safely be called more than once. items MUST NOT be
+// modified and MUST NOT be used after unlock. unlock must be called before
+// writing to the map from the same goroutine, otherwise it deadlocks.
+// It panics if shardIndex is out of range.
+func (m *ConcurrentMap[V]) RLockShard(shardIndex int) (items map[string]V, unlock func()) {
+	shard := m.shardAt(shardIndex)
+	shard.rlock()
+	once := sync.Once{}
+	return shard.items, func() {
+		once.Do(shard.RUnlock)
+	}
+}
+
+// SelectByShard returns the items of the shards at the given indices, each
+// read under its shard's read lock. It panics if an index is out of range.
+func (m *ConcurrentMap[V]) SelectByShard(shardIndices ...int) []Tuple[V] {
+	var entries []Tuple[V]
+	for _, index := range shardIndices {
+		shard := m.shardAt(index)
+		shard.rlock()
+		for key, val := range shard.items {
+			entries = append(entries, Tuple[V]{key, val})
+		}
+		shard.RUnlock()
+	}
+	return entries
+}
+
+func (m *ConcurrentMap[V]) MSet(data map[string]V) {
+	m.checkWrite()
+	if m.keyValidator != nil {
+		for key := range data {
+			m.mustValidate(m.normalize(key))
+		}
+	}
+	for key, value := range data {
+		key = m.normalize(key)
+		shard := m.getShard(key)
+		m.mustLockWrite(shard)
+		start := m.traceStart()
+		var old V
+		var hadOld bool
+		if m.streaming() {
+			old, hadOld = shard.items[key]
+		}
+		m.evict(shard, key)
+		if shard.store(key, value) {
+			m.addCount(1)
+		}
+		m.emit(OpSet, key, old, hadOld, value)
+		shard.Unlock()
+		m.afterWrite("MSet", key, start)
+	}
+}
+
+// MSetCount works like MSet but reports how many keys of data were absent
+// from the map, the rest overwrote existing entries. Keys are grouped by
+// shard so each shard is locked once.
+func (m *ConcurrentMap[V]) MSetCount(data map[string]V) (inserted int) {
+	m.checkWrite()
+	groups := make([][]Tuple[V], m.shardCount)
+	for key, value := range data {
+		key = m.normalize(key)
+		m.mustValidate(key)
+		idx := m.shardIndex(key)
+		groups[idx] = append(groups[idx], Tuple[V]{key, value})
+	}
+	return m.storeGroups(groups)
+}
+
+// storeGroups stores the tuples of groups, whose keys are normalized and
+// grouped by shard index, locking each shard once. It returns how many
+// keys were new.
+func (m *ConcurrentMap[V]) storeGroups(groups [][]Tuple[V]) (inserted int) {
+	for idx, tuples := range groups {
+		if len(tuples) == 0 {
+			continue
+		}
+		shard := m.shards[idx]
+		m.mustLockWrite(shard)
+		for _, t := range tuples {
+			m.evict(shard, t.Key)
+			if _, hadOld := m.put(shard, t.Key, t.Val); !hadOld {
+				inserted++
+			}
+		}
+		shard.Unlock()
+	}
+	return inserted
+}
+
+// bulkBatchSize caps the number of tuples SetBulkFromChannel buffers
+// before storing them.
+const bulkBatchSize = 1024
+
+// SetBulkFromChannel sets the tuples read from ch until it is closed and
+// returns how many were set, overwrites included. Tuples already waiting
+// in ch are buffered, up to bulkBatchSize, and stored grouped by shard, so
+// each shard is locked once per batch; a slow producer still sees its
+// tuples stored as soon as ch runs dry. Like MSet, it panics on a rejected
+// key, the batches stored before are kept.
+func (m *ConcurrentMap[V]) SetBulkFromChannel(ch <-chan Tuple[V]) int {
+	m.checkWrite()
+	groups := make([][]Tuple[V], m.shardCount)
+	total, pending := 0, 0
+	add := func(t Tuple[V]) {
+		key := m.normalize(t.Key)
+		m.mustValidate(key)
+		idx := m.shardIndex(key)
+		groups[idx] = append(groups[idx], Tuple[V]{key, t.Val})
+		pending++
+	}
+	for t := range ch {
+		add(t)
+		closed := false
+	drain:
+		for pending < bulkBatchSize {
+			select {
+			case t, ok := <-ch:
+				if !ok {
+					closed = true
+					break drain
+				}
+				add(t)
+			default:
+				break drain
+			}
+		}
+		m.storeGroups(groups)
+		for i := range groups {
+			groups[i] = groups[i][:0]
+		}
+		total += pending
+		pending = 0
+		if closed {
+			break
+		}
+	}
+	return total
+}
+
+// warmUpProgressEvery is the number of entries loaded between two calls to
+// the progress function of WarmUp.
+const warmUpProgressEvery = 1000
+
+// WarmUp fills the map from a slow source, such as a database scan: source
+// calls emit for every record, and progress, when not nil, is called with
+// the number of entries loaded every 1000 entries. emit may be called
+// from several goroutines, progress calls are serialized. Once ctx is done
+// emit drops the records, source should return as soon as it notices.
+// WarmUp returns the error of source, else the first write error, else
+// ctx's error if it was canceled before source returned. The entries
+// loaded before a failure are kept.
+func (m *ConcurrentMap[V]) WarmUp(ctx context.Context, source func(ctx context.Context, emit func(key string, v V)) error, progress func(loaded int)) error {
+	var mu sync.Mutex
+	var err error
+	loaded := 0
+	emit := func(key string, v V) {
+		if ctx.Err() != nil {
+			return
+		}
+		setErr := m.Set(key, v)
+		mu.Lock()
+		defer mu.Unlock()
+		if setErr != nil {
+			if err == nil {
+				err = setErr
+			}
+			return
+		}
+		loaded++
+		if progress != nil && loaded%warmUpProgressEvery == 0 {
+			progress(loaded)
+		}
+	}
+	if srcErr := source(ctx, emit); srcErr != nil {
+		return srcErr
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Sets the given value under the specified key.
+// It fails if the map is disposed or frozen, key is rejected by
+// WithKeyValidator, or key is new and the map is full, see WithMaxSize.
+func (m *ConcurrentMap[V]) Set(key string, value V) error {
+	if err := m.writeErr(); err != nil {
+		return err
+	}
+	key = m.normalize(key)
+	if err := m.validate(key); err != nil {
+		return err
+	}
+	// Get map shard.
+	shard := m.getShard(key)
+	if err := m.lockWrite(shard); err != nil {
+		return err
+	}
+	if err := m.fullErr(shard, key); err != nil {
+		shard.Unlock()
+		return err
+	}
+	start := m.traceStart()
+	var old V
+	var hadOld bool
+	if m.mutationLog != nil || m.streaming() {
+		old, hadOld = shard.items[key]
+	}
+	m.evict(shard, key)
+	if shard.store(key, value) {
+		m.addCount(1)
+	}
+	m.emit(OpSet, key, old, hadOld, value)
+	shard.Unlock()
+	m.afterWrite("Set", key, start)
+	if m.mutationLog != nil {
+		m.mutationLog.LogSet(key, old, value, hadOld)
+	}
+	if m.metrics != nil {
+		m.metrics.sets.Add(1)
+	}
+	return nil
+}
+
+// MustSet is like Set but panics if Set fails.
+func (m *ConcurrentMap[V]) MustSet(key string, value V) {
+	if err := m.Set(key, value); err != nil {
+		panic(err)
+	}
+}
+
+// SetOnce sets value under key the first time it is called for key; later
+// calls for the same key are no-ops, even after the key has been removed.
+// Concurrent first calls are serialized like sync.Once, exactly one of them
+// stores its value and all return once it is stored. It panics like MustSet
+// if the write fails, and the key is then not marked as set: a later call
+// tries again.
+func (m *ConcurrentMap[V]) SetOnce(key string, value V) {
+	m.checkWrite()
+	key = m.normalize(key)
+	m.mustValidate(key)
+	once := m.onces.MustUpsert(key, nil, func(exist bool, valueInMap, newValue *sync.Once) *sync.Once {
+		if exist {
+			return valueInMap
+		}
+		return &sync.Once{}
+	})
+	var err error
+	once.Do(func() {
+		if err = m.Set(key, value); err != nil {
+			m.onces.Remove(key)
+		}
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Callback to return new element to be inserted into the map
+// It is called while lock is held, therefore it MUST NOT
+// try to access other keys in same map, as it can lead to deadlock since
+// Go sync.RWLock is not reentrant
+type UpsertCb[V any] func(exist bool, valueInMap V, newValue V) V
+
+// Insert or Update - updates existing element or inserts a new one using UpsertCb
+// It fails, without calling cb, if the map is disposed or frozen, key is
+// rejected by WithKeyValidator, or key is new and the map is full, see
+// WithMaxSize.
+func (m *ConcurrentMap[V]) Upsert(key string, value V, cb UpsertCb[V]) (res V, err error) {
+	if err := m.writeErr(); err != nil {
+		return res, err
+	}
+	key = m.normalize(key)
+	if err := m.validate(key); err != nil {
+		return res, err
+	}
+	shard := m.getShard(key)
+	if err := m.lockWrite(shard); err != nil {
+		return res, err
+	}
+	if err := m.fullErr(shard, key); err != nil {
+		shard.Unlock()
+		return res, err
+	}
+	start := m.traceStart()
+	v, ok := shard.items[key]
+	res = cb(ok, v, value)
+	m.evict(shard, key)
+	shard.items[key] = res
+	if !ok {
+		m.addCount(1)
+	}
+	m.emit(OpSet, key, v, ok, res)
+	shard.Unlock()
+	m.afterWrite("Upsert", key, start)
+	if m.mutationLog != nil {
+		m.mutationLog.LogSet(key, v, res, ok)
+	}
+	return res, nil
+}
+
+// MustUpsert is like Upsert but panics if Upsert fails.
+func (m *ConcurrentMap[V]) MustUpsert(key string, value V, cb UpsertCb[V]) V {
+	res, err := m.Upsert(key, value, cb)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// BatchUpsert applies Upsert to every key of data, grouping the keys by shard
+// so each shard's write lock is taken only once for the whole batch.
+// The same locking rules as for Upsert apply to cb. As Upsert fails for
+// them, new keys are skipped, without calling cb, while the map is full
+// (see WithMaxSize); with WithOnEvict items are evicted instead.
+func (m *ConcurrentMap[V]) BatchUpsert(data map[string]V, cb UpsertCb[V]) {
+	m.checkWrite()
+	groups := make([][]Tuple[V], m.shardCount)
+	for key, value := range data {
+		key = m.normalize(key)
+		m.mustValidate(key)
+		idx := m.shardIndex(key)
+		groups[idx] = append(groups[idx], Tuple[V]{key, value})
+	}
+	m.upsertGroups(groups, cb, nil)
+}
+
+// BatchUpsertKeys is BatchUpsert with the same value for every key: cb is
+// called for each of keys, grouped by shard so each shard's write lock is
+// taken once, and the stored values are returned by key. A key listed
+// more than once is upserted that many times. Keys skipped because the map
+// is full, or evicted by a later key of the batch, are not returned.
+// The same locking rules as for Upsert apply to cb.
+func (m *ConcurrentMap[V]) BatchUpsertKeys(keys []string, value V, cb UpsertCb[V]) map[string]V {
+	m.checkWrite()
+	groups := make([][]Tuple[V], m.shardCount)
+	for _, key := range keys {
+		key = m.normalize(key)
+		m.mustValidate(key)
+		idx := m.shardIndex(key)
+		groups[idx] = append(groups[idx], Tuple[V]{key, value})
+	}
+	stored := make(map[string]V, len(keys))
+	m.upsertGroups(groups, cb, stored)
+	return stored
+}
+
+// upsertGroups upserts the tuples of groups, whose keys are normalized and
+// grouped by shard index, locking each shard once. New keys are skipped
+// while the map is full, or make room by evicting. The resulting values
+// are recorded in stored unless it is nil, evicted keys are removed from
+// it.
+func (m *ConcurrentMap[V]) upsertGroups(groups [][]Tuple[V], cb UpsertCb[V], stored map[string]V) {
+	for idx, tuples := range groups {
+		if len(tuples) == 0 {
+			continue
+		}
+		shard := m.shards[idx]
+		m.mustLockWrite(shard)
+		for _, t := range tuples {
+			if m.fullErr(shard, t.Key) != nil {
+				continue
+			}
+			v, ok := shard.items[t.Key]
+			res := cb(ok, v, t.Val)
+			if evicted, ok := m.evict(shard, t.Key); ok && stored != nil {
+				delete(stored, evicted)
+			}
+			m.put(shard, t.Key, res)
+			if stored != nil {
+				stored[t.Key] = res
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+// WithShardRead calls fn with the raw items of the shard holding key while
+// its read lock is held. This is a power user primitive: fn MUST NOT modify
+// items, and MUST NOT call back into the map, as that can deadlock.
+// Only keys sharing the shard of key are present in items.
+func (m *ConcurrentMap[V]) WithShardRead(key string, fn func(items map[string]V)) {
+	key = m.normalize(key)
+	shard := m.getShard(key)
+	shard.rlock()
+	defer shard.RUnlock()
+	fn(shard.items)
+}
+
+// WithShardWrite calls fn with the raw items of the shard holding key while
+// its write lock is held, so several keys of that shard can be updated
+// atomically. This is a power user primitive: fn MUST only touch keys
+// belonging to this shard (see GetShard), otherwise they become unreachable,
+// and MUST NOT call back into the map, as that deadlocks.
+func (m *ConcurrentMap[V]) WithShardWrite(key string, fn func(items map[string]V)) {
+	m.checkWrite()
+	key = m.normalize(key)
+	shard := m.getShard(key)
+	m.mustLockWrite(shard)
+	defer shard.Unlock()
+	before := len(shard.items)
+	var snapshot map[string]V
+	if m.streaming() {
+		snapshot = maps.Clone(shard.items)
+	}
+	defer func() {
+		m.addCount(int64(len(shard.items) - before))
+		if snapshot != nil {
+			m.emitDiff(snapshot, shard.items)
+		}
+	}()
+	fn(shard.items)
+}
+
+// GetOrSet returns the value under key if present, otherwise it sets value
+// and returns it. loaded reports whether the value was already present.
+func (m *ConcurrentMap[V]) GetOrSet(key string, value V) (actual V, loaded bool) {
+	return m.getOrCompute("GetOrSet", key, func() V { return value })
+}
+
+// GetOrCompute returns the value under key if present, otherwise it stores
+// and returns the result of fn, which is called at most once per absent
+// key while the shard's write lock is held and MUST NOT access the map.
+// loaded reports whether the value was already present.
+func (m *ConcurrentMap[V]) GetOrCompute(key string, fn func() V) (actual V, loaded bool) {
+	return m.getOrCompute("GetOrCompute", key, fn)
+}
+
+// getOrCompute implements GetOrSet and GetOrCompute with double-checked
+// locking: hits only take the shard's read lock, the write lock is only
+// taken on a miss, and the key checked again under it since RWMutex
+// cannot be upgraded and another writer may have stored it in between.
+func (m *ConcurrentMap[V]) getOrCompute(op, key string, fn func() V) (V, bool) {
+	key = m.normalize(key)
+	shard := m.getShard(key)
+	if m.frozen.Load() {
+		if v, ok := shard.items[key]; ok {
+			return v, true
+		}
+	} else {
+		shard.rlock()
+		v, ok := shard.items[key]
+		shard.RUnlock()
+		if ok {
+			return v, true
+		}
+	}
+
+	m.checkWrite()
+	m.mustValidate(key)
+	m.mustLockWrite(shard)
+	start := m.traceStart()
+	if v, ok := shard.items[key]; ok {
+		shard.Unlock()
+		m.afterWrite(op, key, start)
+		return v, true
+	}
+	v := fn()
+	m.evict(shard, key)
+	shard.items[key] = v
+	m.addCount(1)
+	var zero V
+	m.emit(OpSet, key, zero, false, v)
+	shard.Unlock()
+	m.afterWrite(op, key, start)
+	if m.mutationLog != nil {
+		m.mutationLog.LogSet(key, zero, v, false)
+	}
+	if m.metrics != nil {
+		m.metrics.sets.Add(1)
+	}
+	return v, false
+}
+
+// Sets the given value under the specified key if no value was associated with it.
+func (m *ConcurrentMap[V]) SetIfAbsent(key string, value V) bool {
+	m.checkWrite()
+	key = m.normalize(key)
+	m.mustValidate(key)
+	// Get map shard.
+	shard := m.getShard(key)
+	m.mustLockWrite(shard)
+	start := m.traceStart()
+	_, ok := shard.items[key]
+	if !ok {
+		m.evict(shard, key)
+		shard.items[key] = value
+		m.addCount(1)
+		var zero V
+		m.emit(OpSet, key, zero, false, value)
+	}
+	shard.Unlock()
+	m.afterWrite("SetIfAbsent", key, start)
+	return !ok
+}
+
+// Get retrieves an element from map under given key.
+func (m *ConcurrentMap[V]) Get(key string) (V, bool) {
+	key = m.normalize(key)
+	// Get shard
+	shard := m.getShard(key)
+	var val V
+	var ok bool
+	if m.frozen.Load() {
+		val, ok = shard.items[key]
+	} else {
+		shard.rlock()
+		// Get item from shard.
+		val, ok = shard.items[key]
+		shard.RUnlock()
+	}
+	if m.metrics != nil {
+		if ok {
+			m.metrics.hits.Add(1)
+		} else {
+			m.metrics.misses.Add(1)
+		}
+	}
+	return val, ok
+}
+
+// TryGet is Get giving up with ErrLockTimeout if the read lock of key's
+// shard cannot be acquired within timeout, for callers with latency
+// bounds. As sync.RWMutex has no timed lock, TryGet polls TryRLock,
+// yielding then sleeping with a growing backoff capped at a millisecond,
+// so the actual wait may exceed timeout by that much and a steady stream
+// of writers may starve it.
+func (m *ConcurrentMap[V]) TryGet(key string, timeout time.Duration) (V, bool, error) {
+	key = m.normalize(key)
+	shard := m.getShard(key)
+	if m.frozen.Load() {
+		val, ok := shard.items[key]
+		return val, ok, nil
+	}
+	start := time.Now()
+	deadline := start.Add(timeout)
+	backoff := time.Microsecond
+	contended := false
+	for spins := 0; !shard.TryRLock(); spins++ {
+		contended = true
+		if !time.Now().Before(deadline) {
+			var zero V
+			return zero, false, fmt.Errorf("%w (%s, key %q)", ErrLockTimeout, m.prefix(), key)
+		}
+		if spins < 16 {
+			runtime.Gosched()
+			continue
+		}
+		time.Sleep(backoff)
+		if backoff < time.Millisecond {
+			backoff *= 2
+		}
+	}
+	if shard.stats != nil {
+		if contended {
+			shard.stats.readContended.Add(1)
+		}
+		shard.stats.readWaitNs.Add(uint64(time.Since(start)))
+		shard.stats.readOps.Add(1)
+	}
+	val, ok := shard.items[key]
+	shard.RUnlock()
+	if m.metrics != nil {
+		if ok {
+			m.metrics.hits.Add(1)
+		} else {
+			m.metrics.misses.Add(1)
+		}
+	}
+	return val, ok, nil
+}
+
+// GetBatch looks up keys and returns their values and presence aligned with
+// keys: values[i] and found[i] belong to keys[i]. Lookups are grouped by
+// shard, each shard's read lock is taken once.
+func (m *ConcurrentMap[V]) GetBatch(keys []string) (values []V, found []bool) {
+	m.lazyInit()
+	values = make([]V, len(keys))
+	found = make([]bool, len(keys))
+	groups := make([][]int, m.shardCount)
+	normalized := make([]string, len(keys))
+	for i, key := range keys {
+		normalized[i] = m.normalize(key)
+		idx := m.shardIndex(normalized[i])
+		groups[idx] = append(groups[idx], i)
+	}
+	hits := 0
+	for idx, positions := range groups {
+		if len(positions) == 0 {
+			continue
+		}
+		shard := m.shards[idx]
+		shard.rlock()
+		for _, i := range positions {
+			values[i], found[i] = shard.items[normalized[i]]
+			if found[i] {
+				hits++
+			}
+		}
+		shard.RUnlock()
+	}
+	if m.metrics != nil {
+		m.metrics.hits.Add(int64(hits))
+		m.metrics.misses.Add(int64(len(keys) - hits))
+	}
+	return values, found
+}
+
+// Count returns the number of elements within the map.
+// The count is maintained on every write, so this is O(1).
+func (m *ConcurrentMap[V]) Count() int {
+	return int(m.count.Load())
+}
+
+// Len is an alias of Count.
+func (m *ConcurrentMap[V]) Len() int {
+	return m.Count()
+}
+
+// Looks up an item under specified key
+func (m *ConcurrentMap[V]) Has(key string) bool {
+	key = m.normalize(key)
+	// Get shard
+	shard := m.getShard(key)
+	if m.frozen.Load() {
+		_, ok := shard.items[key]
+		return ok
+	}
+	shard.rlock()
+	// See if element is within shard.
+	_, ok := shard.items[key]
+	shard.RUnlock()
+	return ok
+}
+
+// Remove removes an element from the map.
+// It fails only if the map is disposed or frozen.
+func (m *ConcurrentMap[V]) Remove(key string) error {
+	if err := m.writeErr(); err != nil {
+		return err
+	}
+	key = m.normalize(key)
+	// Try to get shard.
+	shard := m.getShard(key)
+	if err := m.lockWrite(shard); err != nil {
+		return err
+	}
+	start := m.traceStart()
+	v, ok := shard.remove(key)
+	if ok {
+		m.addCount(-1)
+		m.emitDelete(key, v)
+	}
+	shard.Unlock()
+	m.afterWrite("Remove", key, start)
+	if m.mutationLog != nil {
+		m.mutationLog.LogDelete(key, v, ok)
+	}
+	if m.metrics != nil {
+		m.metrics.removes.Add(1)
+	}
+	return nil
+}
+
+// MustRemove is like Remove but panics if Remove fails.
+func (m *ConcurrentMap[V]) MustRemove(key string) {
+	if err := m.Remove(key); err != nil {
+		panic(err)
+	}
+}
+
+// RemoveAndCheckEmpty removes key and reports whether it was present, and
+// whether the map held no items right after the removal.
+func (m *ConcurrentMap[V]) RemoveAndCheckEmpty(key string) (removed bool, mapEmpty bool) {
+	m.checkWrite()
+	key = m.normalize(key)
+	shard := m.getShard(key)
+	m.mustLockWrite(shard)
+	start := m.traceStart()
+	v, removed := shard.remove(key)
+	var count int64
+	if removed {
+		count = m.addCount(-1)
+		m.emitDelete(key, v)
+	} else {
+		count = m.count.Load()
+	}
+	shard.Unlock()
+	m.afterWrite("RemoveAndCheckEmpty", key, start)
+	return removed, count == 0
+}
+
+// Metrics returns the current operation counters.
+// All counters are zero unless the map was created with WithMetrics.
+func (m *ConcurrentMap[V]) Metrics() MapMetrics {
+	if m.metrics == nil {
+		return MapMetrics{}
+	}
+	return MapMetrics{
+		Name:    m.name,
+		Hits:    m.metrics.hits.Load(),
+		Misses:  m.metrics.misses.Load(),
+		Sets:    m.metrics.sets.Load(),
+		Removes: m.metrics.removes.Load(),
+	}
+}
+
+// RemoveCb is a callback executed in a map.RemoveCb() call, while Lock is held
+// If returns true, the element will be removed from the map
+type RemoveCb[V any] func(key string, v V, exists bool) bool
+
+// RemoveCb locks the shard containing the key, retrieves its current value and calls the callback with those params
+// If callback returns true and element exists, it will remove it from the map
+// Returns the value returned by the callback (even if element was not present in the map)
+func (m *ConcurrentMap[V]) RemoveCb(key string, cb RemoveCb[V]) bool {
+	m.checkWrite()
+	key = m.normalize(key)
+	// Try to get shard.
+	shard := m.getShard(key)
+	m.mustLockWrite(shard)
+	start := m.traceStart()
+	v, ok := shard.items[key]
+	remove := cb(key, v, ok)
+	if remove && ok {
+		delete(shard.items, key)
+		m.addCount(-1)
+		m.emitDelete(key, v)
+	}
+	shard.Unlock()
+	m.afterWrite("RemoveCb", key, start)
+	if remove && m.mutationLog != nil {
+		m.mutationLog.LogDelete(key, v, ok)
+	}
+	return remove
+}
+
+// Pop removes an element from the map and returns it
+func (m *ConcurrentMap[V]) Pop(key string) (v V, exists bool) {
+	m.checkWrite()
+	key = m.normalize(key)
+	// Try to get shard.
+	shard := m.getShard(key)
+	m.mustLockWrite(shard)
+	start := m.traceStart()
+	v, exists = shard.remove(key)
+	if exists {
+		m.addCount(-1)
+		m.emitDelete(key, v)
+	}
+	shard.Unlock()
+	m.afterWrite("Pop", key, start)
+	if m.mutationLog != nil {
+		m.mutationLog.LogDelete(key, v, exists)
+	}
+	return v, exists
+}
+
+// Rename moves the value of oldKey to newKey and reports whether oldKey
+// existed; nothing changes if it did not. An existing value of newKey is
+// overwritten. Both shards are write locked for the move, in ascending
+// index order when they differ, so no reader ever sees both keys or
+// neither of them.
+func (m *ConcurrentMap[V]) Rename(oldKey, newKey string) bool {
+	m.checkWrite()
+	oldKey, newKey = m.normalize(oldKey), m.normalize(newKey)
+	m.mustValidate(newKey)
+	from, to := m.shardIndex(oldKey), m.shardIndex(newKey)
+	first, second := from, to
+	if first > second {
+		first, second = second, first
+	}
+	m.shards[first].lock()
+	if second != first {
+		m.shards[second].lock()
+	}
+	if err := m.writeErr(); err != nil {
+		if second != first {
+			m.shards[second].Unlock()
+		}
+		m.shards[first].Unlock()
+		panic(err)
+	}
+	start := m.traceStart()
+	src, dst := m.shards[from], m.shards[to]
+	v, ok := src.items[oldKey]
+	var prev V
+	var hadPrev bool
+	if ok && oldKey != newKey {
+		prev, hadPrev = dst.items[newKey]
+		delete(src.items, oldKey)
+		dst.items[newKey] = v
+		if hadPrev {
+			m.addCount(-1)
+		}
+		m.emitDelete(oldKey, v)
+		m.emit(OpSet, newKey, prev, hadPrev, v)
+	}
+	if second != first {
+		m.shards[second].Unlock()
+	}
+	m.shards[first].Unlock()
+	m.afterWrite("Rename", oldKey, start)
+	if ok && oldKey != newKey && m.mutationLog != nil {
+		m.mutationLog.LogDelete(oldKey, v, true)
+		m.mutationLog.LogSet(newKey, prev, v, hadPrev)
+	}
+	return ok
+}
+
+// fullErr returns the error rejecting the insertion of key in shard, whose
+// write lock is held, if key is new and the map holds its max size, see
+// WithMaxSize. Maps with WithOnEvict evict instead of rejecting.
+func (m *ConcurrentMap[V]) fullErr(shard *ConcurrentMapShared[V], key string) error {
+	if m.maxSize == 0 || m.onEvict != nil || m.count.Load() < m.maxSize {
+		return nil
+	}
+	if _, ok := shard.items[key]; ok {
+		return nil
+	}
+	if m.name != "" {
+		return fmt.Errorf("%w (map %q, max size %d)", ErrMapFull, m.name, m.maxSize)
+	}
+	return fmt.Errorf("%w (max size %d)", ErrMapFull, m.maxSize)
+}
+
+// put stores value under key in shard, whose write lock is held, keeping
+// the item count and the change streams up to date. It returns the value
+// it replaced, if any.
+func (m *ConcurrentMap[V]) put(shard *ConcurrentMapShared[V], key string, value V) (old V, hadOld bool) {
+	old, hadOld = shard.items[key]
+	shard.items[key] = value
+	if !hadOld {
+		m.addCount(1)
+	}
+	m.emit(OpSet, key, old, hadOld, value)
+	return old, hadOld
+}
+
+// del is put for the removal of key.
+func (m *ConcurrentMap[V]) del(shard *ConcurrentMapShared[V], key string) (V, bool) {
+	v, ok := shard.remove(key)
+	if ok {
+		m.addCount(-1)
+		m.emitDelete(key, v)
+	}
+	return v, ok
+}
+
+// evict removes an item of shard, whose write lock is held, to make room
+// for key if key is new and the map is full, see WithOnEvict. It returns
+// the evicted key, if any.
+func (m *ConcurrentMap[V]) evict(shard *ConcurrentMapShared[V], key string) (string, bool) {
+	if m.onEvict == nil || m.maxSize == 0 || m.count.Load() < m.maxSize {
+		return "", false
+	}
+	if _, ok := shard.items[key]; ok {
+		return "", false
+	}
+	for evicted, val := range shard.items {
+		delete(shard.items, evicted)
+		// Bypass addCount, the map is not becoming empty: key is about to
+		// be inserted.
+		m.count.Add(-1)
+		m.emitDelete(evicted, val)
+		m.onEvict(evicted, val)
+		return evicted, true
+	}
+	return "", false
+}
+
+// addCount adjusts the item count by delta, which callers apply under the
+// lock of the modified shard. It wakes up NotifyOnEmpty when a removal left
+// the map empty, and NotifyOnFull when an insertion filled it.
+func (m *ConcurrentMap[V]) addCount(delta int64) int64 {
+	count := m.count.Add(delta)
+	if m.maxSize > 0 && delta > 0 && count >= m.maxSize {
+		m.fullOnce.Do(func() { close(m.full) })
+	}
+	if count == 0 && delta < 0 {
+		m.emptyMu.Lock()
+		for _, ch := range m.emptyWaiters {
+			close(ch)
+		}
+		m.emptyWaiters = nil
+		m.emptyMu.Unlock()
+	}
+	return count
+}
+
+// NotifyOnEmpty returns a channel closed once the map becomes empty, that
+// is the next time a removal (Remove, Pop, Clear, PopAll, Dispose...) takes
+// the count to zero. The channel is already closed if the map is empty.
+func (m *ConcurrentMap[V]) NotifyOnEmpty() <-chan struct{} {
+	ch := make(chan struct{})
+	m.emptyMu.Lock()
+	defer m.emptyMu.Unlock()
+	if m.count.Load() == 0 {
+		close(ch)
+		return ch
+	}
+	m.emptyWaiters = append(m.emptyWaiters, ch)
+	return ch
+}
+
+// NotifyOnFull returns a channel closed the first time Count reaches the
+// size set by WithMaxSize. It stays closed even if items are removed
+// afterwards. Without WithMaxSize the channel is nil and never fires.
+func (m *ConcurrentMap[V]) NotifyOnFull() <-chan struct{} {
+	m.lazyInit()
+	return m.full
+}
+
+// IsEmpty checks if map is empty.
+func (m *ConcurrentMap[V]) IsEmpty() bool {
+	return m.Count() == 0
+}
+
+// Equal reports whether both maps hold the same keys with values equal
+// according to eq. It holds the read locks of every shard of both maps for
+// the duration of the comparison, acquired in a fixed order across maps,
+// and returns as soon as a difference is found.
+func (m *ConcurrentMap[V]) Equal(other *ConcurrentMap[V], eq func(a, b V) bool) bool {
+	m.lazyInit()
+	other.lazyInit()
+	if m.id == other.id {
+		return true
+	}
+	first, second := m, other
+	if second.id < first.id {
+		first, second = second, first
+	}
+	for _, shard := range first.shards {
+		shard.rlock()
+		defer shard.RUnlock()
+	}
+	for _, shard := range second.shards {
+		shard.rlock()
+		defer shard.RUnlock()
+	}
+
+	count := 0
+	for _, shard := range m.shards {
+		count += len(shard.items)
+	}
+	for _, shard := range other.shards {
+		count -= len(shard.items)
+	}
+	if count != 0 {
+		return false
+	}
+	for _, shard := range m.shards {
+		for key, a := range shard.items {
+			b, ok := other.shards[other.shardIndex(key)].items[key]
+			if !ok || !eq(a, b) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Used by the Iter & IterBuffered functions to wrap two variables together over a channel,
+type Tuple[V any] struct {
+	Key string
+	Val V
+}
+
+// Iter returns an iterator which could be used in a for range loop.
+//
+// Deprecated: using IterBuffered() will get a better performence
+func (m *ConcurrentMap[V]) Iter() <-chan Tuple[V] {
+	chans := snapshot(m)
+	ch := make(chan Tuple[V])
+	go fanIn(chans, ch)
+	return ch
+}
+
+// IterBuffered returns a buffered iterator which could be used in a for range loop.
+func (m *ConcurrentMap[V]) IterBuffered() <-chan Tuple[V] {
+	chans := snapshot(m)
+	total := 0
+	for _, c := range chans {
+		total += cap(c)
+	}
+	ch := make(chan Tuple[V], total)
+	if m.sequential {
+		// ch has room for every item, no need for a goroutine.
+		drain(chans, ch)
+	} else {
+		go fanIn(chans, ch)
+	}
+	return ch
+}
+
+func (m *ConcurrentMap[V]) PopAll() <-chan Tuple[V] {
+	m.checkWrite()
+	chans, err := popAll(m)
+	if err != nil {
+		panic(err)
+	}
+	total := 0
+	for _, c := range chans {
+		total += cap(c)
+	}
+	ch := make(chan Tuple[V], total)
+	if m.sequential {
+		// ch has room for every item, no need for a goroutine.
+		drain(chans, ch)
+	} else {
+		go fanIn(chans, ch)
+	}
+	return ch
+}
+
+// PopIf removes every item for which pred returns true and returns them.
+// Each shard is processed under its write lock, so pred MUST NOT access m.
+func (m *ConcurrentMap[V]) PopIf(pred func(key string, v V) bool) map[string]V {
+	m.checkWrite()
+	popped := make(map[string]V)
+	for _, shard := range m.shards {
+		m.mustLockWrite(shard)
+		for key, val := range shard.items {
+			if pred(key, val) {
+				popped[key] = val
+				m.del(shard, key)
+			}
+		}
+		shard.Unlock()
+	}
+	return popped
+}
+
+// SplitByKey moves every item whose key matches pred into a new map, which
+// is returned. Each shard is processed under its write lock, so an item is
+// always in exactly one of both maps, and pred MUST NOT access m. The new
+// map has the same shard count, sharding, key transformer and key
+// validator as m.
+func (m *ConcurrentMap[V]) SplitByKey(pred func(key string) bool) *ConcurrentMap[V] {
+	m.checkWrite()
+	split := m.derived()
+	for i, shard := range m.shards {
+		moved := 0
+		m.mustLockWrite(shard)
+		for key, val := range shard.items {
+			if pred(key) {
+				split.shards[i].items[key] = val
+				delete(shard.items, key)
+				m.emitDelete(key, val)
+				moved++
+			}
+		}
+		m.addCount(-int64(moved))
+		shard.Unlock()
+		split.addCount(int64(moved))
+	}
+	return split
+}
+
+// Partition copies the items of m into n new maps, each item going to the
+// map at index groupOf(key, v) modulo n, negative results counting from
+// the end. m is left unchanged. Each shard is copied under its read lock,
+// groupOf MUST NOT write to m. The new maps have the same shard count,
+// sharding, key transformer and key validator as m. It panics if n is not
+// positive.
+func (m *ConcurrentMap[V]) Partition(n int, groupOf func(key string, v V) int) []*ConcurrentMap[V] {
+	if n <= 0 {
+		panic(fmt.Sprintf("%s: partition count %d must be positive", m.prefix(), n))
+	}
+	m.lazyInit()
+	parts := make([]*ConcurrentMap[V], n)
+	for i := range parts {
+		parts[i] = m.derived()
+	}
+	counts := make([]int64, n)
+	for i, shard := range m.shards {
+		shard.rlock()
+		for key, val := range shard.items {
+			g := groupOf(key, val) % n
+			if g < 0 {
+				g += n
+			}
+			parts[g].shards[i].items[key] = val
+			counts[g]++
+		}
+		shard.RUnlock()
+	}
+	for i, part := range parts {
+		part.addCount(counts[i])
+	}
+	return parts
+}
+
+// Chunk copies the items of m into n new, independent maps whose sizes
+// differ by at most one, items being dealt in turn as the shards are
+// read. It is Partition with a round robin grouping, and panics if n is
+// not positive.
+func (m *ConcurrentMap[V]) Chunk(n int) []*ConcurrentMap[V] {
+	next := -1
+	return m.Partition(n, func(string, V) int {
+		next = (next + 1) % n
+		return next
+	})
+}
+
+// Clear removes all items from map.
+func (m *ConcurrentMap[V]) Clear() {
+	m.checkWrite()
+	for item := range m.IterBuffered() {
+		m.Remove(item.Key)
+	}
+}
+
+// Shrink releases the memory kept by the shards after mass deletions, as Go
+// maps never shrink: each shard, under its write lock, has its items copied
+// into a new map sized for them, which replaces the oversized one. It costs
+// a copy of the whole map, one shard at a time. Frozen maps are left alone,
+// as they are read without locking.
+func (m *ConcurrentMap[V]) Shrink() {
+	m.lazyInit()
+	if m.frozen.Load() {
+		return
+	}
+	for _, shard := range m.shards {
+		shard.lock()
+		if m.frozen.Load() {
+			// Frozen meanwhile.
+			shard.Unlock()
+			return
+		}
+		items := make(map[string]V, len(shard.items))
+		for key, val := range shard.items {
+			items[key] = val
+		}
+		shard.items = items
+		shard.Unlock()
+	}
+}
+
+// PipelineTo sends every item of m to out and returns once all are sent.
+// Unlike IterBuffered no channel is allocated, the caller controls the
+// buffering of out, and out is not closed, so several maps can feed the
+// same channel. Items are sent while their shard's read lock is held: a
+// slow receiver delays writers of that shard, and the receiver MUST NOT
+// write to m, as that can deadlock.
+func (m *ConcurrentMap[V]) PipelineTo(out chan<- Tuple[V]) {
+	m.IterCb(func(key string, v V) {
+		out <- Tuple[V]{key, v}
+	})
+}
+
+// Returns a array of channels that contains elements in each shard,
+// which likely takes a snapshot of `m`.
+// It returns once the size of each buffered channel is determined,
+// before all the channels are populated using goroutines.
+func snapshot[V any](m *ConcurrentMap[V]) (chans []chan Tuple[V]) {
+	m.lazyInit()
+	chans = make([]chan Tuple[V], m.shardCount)
+	if m.sequential {
+		for index, shard := range m.shards {
+			shard.rlock()
+			chans[index] = make(chan Tuple[V], len(shard.items))
+			for key, val := range shard.items {
+				chans[index] <- Tuple[V]{key, val}
+			}
+			shard.RUnlock()
+			close(chans[index])
+		}
+		return chans
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(m.shardCount)
+	// Foreach shard.
+	for index, shard := range m.shards {
+		go func(index int, shard *ConcurrentMapShared[V]) {
+			// Foreach key, value pair.
+			shard.rlock()
+			chans[index] = make(chan Tuple[V], len(shard.items))
+			wg.Done()
+			for key, val := range shard.items {
+				chans[index] <- Tuple[V]{key, val}
+			}
+			shard.RUnlock()
+			close(chans[index])
+		}(index, shard)
+	}
+	wg.Wait()
+	return chans
+}
+
+// Returns a array of channels that contains elements in each shard and clears the map.
+// The shards found frozen or disposed once locked are left untouched, their
+// channel is empty, and the error of the last of them is returned.
+func popAll[V any](m *ConcurrentMap[V]) (chans []chan Tuple[V], err error) {
+	m.lazyInit()
+	chans = make([]chan Tuple[V], m.shardCount)
+	if m.sequential {
+		for index, shard := range m.shards {
+			if lockErr := m.lockWrite(shard); lockErr != nil {
+				chans[index] = make(chan Tuple[V])
+				close(chans[index])
+				err = lockErr
+				continue
+			}
+			chans[index] = make(chan Tuple[V], len(shard.items))
+			for key, val := range shard.items {
+				chans[index] <- Tuple[V]{key, val}
+				m.emitDelete(key, val)
+			}
+			close(chans[index])
+			m.addCount(-int64(len(shard.items)))
+			shard.items = make(map[string]V, m.shardCapacity)
+			shard.Unlock()
+		}
+		return chans, err
+	}
+	var errMu sync.Mutex
+	wg := sync.WaitGroup{}
+	wg.Add(m.shardCount)
+	// Foreach shard.
+	for index, shard := range m.shards {
+		go func(index int, shard *ConcurrentMapShared[V]) {
+			// Foreach key, value pair.
+			if lockErr := m.lockWrite(shard); lockErr != nil {
+				chans[index] = make(chan Tuple[V])
+				close(chans[index])
+				errMu.Lock()
+				err = lockErr
+				errMu.Unlock()
+				wg.Done()
+				return
+			}
+			chans[index] = make(chan Tuple[V], len(shard.items))
+			wg.Done()
+			for key, val := range shard.items {
+				chans[index] <- Tuple[V]{key, val}
+				m.emitDelete(key, val)
+			}
+			close(chans[index])
+			m.addCount(-int64(len(shard.items)))
+			shard.items = make(map[string]V, m.shardCapacity)
+			shard.Unlock()
+		}(index, shard)
+	}
+	wg.Wait()
+	return chans, err
+}
+
+// drain copies the elements of the closed channels `chans` into channel
+// `out`, which must have room for all of them, and closes it.
+func drain[V any](chans []chan Tuple[V], out chan Tuple[V]) {
+	for _, ch := range chans {
+		for t := range ch {
+			out <- t
+		}
+	}
+	close(out)
+}
+
+// fanIn reads elements from channels `chans` into channel `out`
+func fanIn[V any](chans []chan Tuple[V], out chan Tuple[V]) {
+	wg := sync.WaitGroup{}
+	wg.Add(len(chans))
+	for _, ch := range chans {
+		go func(ch chan Tuple[V]) {
+			for t := range ch {
+				out <- t
+			}
+			wg.Done()
+		}(ch)
+	}
+	wg.Wait()
+	close(out)
+}
+
+// Items returns all items as map[string]V
+func (m *ConcurrentMap[V]) Items() map[string]V {
+	tmp := make(map[string]V)
+
+	// Insert items to temporary map.
+	for item := range m.IterBuffered() {
+		tmp[item.Key] = item.Val
+	}
+
+	return tmp
+}
+
+// Entries returns all items as []Tuple[V]
+func (m *ConcurrentMap[V]) Entries() []Tuple[V] {
+	entries := make([]Tuple[V], 0, m.Count())
+	for item := range m.IterBuffered() {
+		entries = append(entries, item)
+	}
+	return entries
+}
+
+// Diff compares m, the old state, with other, the new one: added holds the
+// items of other whose key is missing from m, removed the items of m whose
+// key is missing from other, and changed the items of other whose value
+// differs, according to eq, from the one in m. Both maps are snapshotted
+// shard by shard, one after the other, and each snapshot is walked once.
+func (m *ConcurrentMap[V]) Diff(other *ConcurrentMap[V], eq func(a, b V) bool) (added, removed, changed []Tuple[V]) {
+	old := m.Items()
+	for _, entry := range other.Entries() {
+		v, ok := old[entry.Key]
+		if !ok {
+			added = append(added, entry)
+			continue
+		}
+		if !eq(v, entry.Val) {
+			changed = append(changed, entry)
+		}
+		delete(old, entry.Key)
+	}
+	for key, v := range old {
+		removed = append(removed, Tuple[V]{key, v})
+	}
+	return added, removed, changed
+}
+
+// Subset reports whether every key of m is present in other with a value
+// equal according to eq. The receiver is snapshotted first, so the locks
+// of both maps are never held at the same time.
+func (m *ConcurrentMap[V]) Subset(other *ConcurrentMap[V], eq func(a, b V) bool) bool {
+	for _, entry := range m.Entries() {
+		v, ok := other.Get(entry.Key)
+		if !ok || !eq(entry.Val, v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Iterator callbacalled for every key,value found in
+// maps. RLock is held for all calls for a given shard
+// therefore callback sess consistent view of a shard,
+// but not across the shards
+type IterCb[V any] func(key string, v V)
+
+// Callback based iterator, cheapest way to read
+// all elements in a map.
+func (m *ConcurrentMap[V]) IterCb(fn IterCb[V]) {
+	m.lazyInit()
+	for idx := range m.shards {
+		shard := (m.shards)[idx]
+		shard.rlock()
+		for key, value := range shard.items {
+			fn(key, value)
+		}
+		shard.RUnlock()
+	}
+}
+
+// IterRangeByHash is IterCb restricted to the items whose key hashes, with
+// the map's sharding function, into [minHash, maxHash]. As keys go to the
+// shard of index hash modulo the shard count, only ranges narrower than
+// the shard count allow skipping shards; wider ranges visit every shard
+// and filter its items. The usual IterCb locking rules apply to fn.
+func (m *ConcurrentMap[V]) IterRangeByHash(minHash, maxHash uint64, fn IterCb[V]) {
+	if minHash > maxHash {
+		return
+	}
+	m.lazyInit()
+	// Shards are picked from uint(hash) like shardIndex does, which keeps
+	// only the low bits of the hashes on 32-bit platforms. The truncated
+	// range wraps around if it crosses a multiple of 2^32, every shard is
+	// scanned then. The residues of a range narrower than count are
+	// [lo, hi], or wrap around to [lo, count) and [0, hi].
+	count := uint(m.shardCount)
+	lo, hi := uint(minHash), uint(maxHash)
+	all := maxHash-minHash >= uint64(count-1) || lo > hi
+	lo, hi = lo%count, hi%count
+	for idx, shard := range m.shards {
+		i := uint(idx)
+		if !all && (lo <= hi && (i < lo || i > hi) || lo > hi && i < lo && i > hi) {
+			continue
+		}
+		shard.rlock()
+		for key, value := range shard.items {
+			if h := m.sharding(key); h >= minHash && h <= maxHash {
+				fn(key, value)
+			}
+		}
+		shard.RUnlock()
+	}
+}
+
+// All returns an iterator over the items of m, for use with range. Shards
+// are visited one after the other, each under its read lock, which is held
+// while the loop body runs: the body MUST NOT write to m. Breaking out of
+// the loop releases the lock.
+func (m *ConcurrentMap[V]) All() iter.Seq2[string, V] {
+	return func(yield func(string, V) bool) {
+		m.lazyInit()
+		for _, shard := range m.shards {
+			if !yieldShard(shard, yield) {
+				return
+			}
+		}
+	}
+}
+
+// Vals is All for the values only.
+func (m *ConcurrentMap[V]) Vals() iter.Seq[V] {
+	return func(yield func(V) bool) {
+		for _, v := range m.All() {
+			if !yield(v) {
+				return
+			}
+		}
+	}
+}
+
+// yieldShard calls yield for the items of shard under its read lock until
+// yield returns false, and reports whether it never did.
+func yieldShard[V any](shard *ConcurrentMapShared[V], yield func(string, V) bool) bool {
+	shard.rlock()
+	defer shard.RUnlock()
+	for key, val := range shard.items {
+		if !yield(key, val) {
+			return false
+		}
+	}
+	return true
+}
+
+// IterCbParallel is IterCb with the shards spread over a pool of workers
+// goroutines, each holding the read lock of the shard it is visiting while
+// it calls fn. fn is therefore called concurrently and must be safe for
+// concurrent use; it MUST NOT write to m. A workers count below 1 is
+// treated as 1. IterCbParallel returns once every item has been visited.
+func (m *ConcurrentMap[V]) IterCbParallel(workers int, fn IterCb[V]) {
+	m.lazyInit()
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > m.shardCount {
+		workers = m.shardCount
+	}
+	shards := make(chan *ConcurrentMapShared[V], m.shardCount)
+	for _, shard := range m.shards {
+		shards <- shard
+	}
+	close(shards)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for shard := range shards {
+				shard.rlock()
+				for key, value := range shard.items {
+					fn(key, value)
+				}
+				shard.RUnlock()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Sample returns n items chosen uniformly at random, using reservoir
+// sampling (Algorithm R) in a single pass over the map.
+// If n is not smaller than the number of items, all items are returned.
+func (m *ConcurrentMap[V]) Sample(n int) []Tuple[V] {
+	if n <= 0 {
+		return nil
+	}
+	if n >= m.Count() {
+		return m.Entries()
+	}
+	reservoir := make([]Tuple[V], 0, n)
+	seen := 0
+	visit := func(key string, v V) {
+		seen++
+		if len(reservoir) < n {
+			reservoir = append(reservoir, Tuple[V]{key, v})
+		} else if j := m.randIntn(seen); j < n {
+			reservoir[j] = Tuple[V]{key, v}
+		}
+	}
+	m.lazyInit()
+	for _, shard := range m.shards {
+		shard.rlock()
+		m.sampleVisit(shard, visit)
+		shard.RUnlock()
+	}
+	return reservoir
+}
+
+// SampleShards is a cheaper Sample for small samples of large maps: it
+// returns up to n items and only scans the shards it draws them from,
+// instead of the whole map. Shards are drawn with a probability
+// proportional to their size, read under each shard's read lock in turn,
+// then items are reservoir sampled within each drawn shard. The sample is
+// uniform as long as the map is not modified meanwhile; concurrent
+// removals may make it smaller than min(n, Count()).
+func (m *ConcurrentMap[V]) SampleShards(n int) []Tuple[V] {
+	if n <= 0 {
+		return nil
+	}
+	m.lazyInit()
+	avail := make([]int, m.shardCount)
+	total := 0
+	for i, shard := range m.shards {
+		avail[i] = shard.Len()
+		total += avail[i]
+	}
+	// take[i] items are drawn from shard i, as if n distinct items were
+	// picked at random among total.
+	take := make([]int, m.shardCount)
+	for ; n > 0 && total > 0; n-- {
+		r := m.randIntn(total)
+		i := 0
+		for r >= avail[i] {
+			r -= avail[i]
+			i++
+		}
+		avail[i]--
+		take[i]++
+		total--
+	}
+
+	var sample []Tuple[V]
+	for i, shard := range m.shards {
+		k := take[i]
+		if k == 0 {
+			continue
+		}
+		start := len(sample)
+		seen := 0
+		shard.rlock()
+		m.sampleVisit(shard, func(key string, v V) {
+			seen++
+			if seen <= k {
+				sample = append(sample, Tuple[V]{key, v})
+			} else if j := m.randIntn(seen); j < k {
+				sample[start+j] = Tuple[V]{key, v}
+			}
+		})
+		shard.RUnlock()
+	}
+	return sample
 }
 
-// Remove removes an element from the map.
-func (m ConcurrentMap[V]) Remove(key string) {
-	// Try to get shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	delete(shard.items, key)
-	shard.Unlock()
+// sampleVisit calls visit for every item of shard, whose read lock is held.
+// With WithRandSource the items are visited in key order, since map
+// iteration order is random, so samples only depend on the seed and the
+// map contents.
+func (m *ConcurrentMap[V]) sampleVisit(shard *ConcurrentMapShared[V], visit func(key string, v V)) {
+	if m.rnd == nil {
+		for key, val := range shard.items {
+			visit(key, val)
+		}
+		return
+	}
+	keys := make([]string, 0, len(shard.items))
+	for key := range shard.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		visit(key, shard.items[key])
+	}
 }
 
-// RemoveCb is a callback executed in a map.RemoveCb() call, while Lock is held
-// If returns true, the element will be removed from the map
-type RemoveCb[V any] func(key string, v V, exists bool) bool
-
-// RemoveCb locks the shard containing the key, retrieves its current value and calls the callback with those params
-// If callback returns true and element exists, it will remove it from the map
-// Returns the value returned by the callback (even if element was not present in the map)
-func (m ConcurrentMap[V]) RemoveCb(key string, cb RemoveCb[V]) bool {
-	// Try to get shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	v, ok := shard.items[key]
-	remove := cb(key, v, ok)
-	if remove && ok {
-		delete(shard.items, key)
+// randIntn returns a random number in [0, n) from the map's random source.
+func (m *ConcurrentMap[V]) randIntn(n int) int {
+	if m.rnd == nil {
+		return rand.Intn(n)
 	}
-	shard.Unlock()
-	return remove
+	m.rndMu.Lock()
+	defer m.rndMu.Unlock()
+	return m.rnd.Intn(n)
 }
 
-// Pop removes an element from the map and returns it
-func (m ConcurrentMap[V]) Pop(key string) (v V, exists bool) {
-	// Try to get shard.
-	shard := m.GetShard(key)
-	shard.Lock()
-	v, exists = shard.items[key]
-	delete(shard.items, key)
-	shard.Unlock()
-	return v, exists
-}
+// ForEachBatch calls fn with consecutive batches of exactly batchSize
+// items, the last batch holding the remainder. Batches span shards; each
+// shard is copied under its read lock and fn is called without any lock
+// held, so it may access the map. Iteration stops at the first error
+// returned by fn, which is then returned.
+func (m *ConcurrentMap[V]) ForEachBatch(batchSize int, fn func(batch []Tuple[V]) error) error {
+	if batchSize <= 0 {
+		return errors.New(m.prefix() + ": batch size must be greater than 0")
+	}
+	m.lazyInit()
+	batch := make([]Tuple[V], 0, batchSize)
+	for _, shard := range m.shards {
+		shard.rlock()
+		pending := make([]Tuple[V], 0, len(shard.items))
+		for key, val := range shard.items {
+			pending = append(pending, Tuple[V]{key, val})
+		}
+		shard.RUnlock()
 
-// IsEmpty checks if map is empty.
-func (m ConcurrentMap[V]) IsEmpty() bool {
-	return m.Count() == 0
+		for len(pending) > 0 {
+			n := min(batchSize-len(batch), len(pending))
+			batch = append(batch, pending[:n]...)
+			pending = pending[n:]
+			if len(batch) == batchSize {
+				if err := fn(batch); err != nil {
+					return err
+				}
+				batch = make([]Tuple[V], 0, batchSize)
+			}
+		}
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
 }
 
-// Used by the Iter & IterBuffered functions to wrap two variables together over a channel,
-type Tuple[V any] struct {
-	Key string
-	Val V
+// MaxBy returns the item with the greatest value according to less, and
+// false if the map is empty. Ties are resolved arbitrarily.
+func (m *ConcurrentMap[V]) MaxBy(less func(a, b V) bool) (Tuple[V], bool) {
+	var best Tuple[V]
+	found := false
+	m.IterCb(func(key string, v V) {
+		if !found || less(best.Val, v) {
+			best = Tuple[V]{key, v}
+			found = true
+		}
+	})
+	return best, found
 }
 
-// Iter returns an iterator which could be used in a for range loop.
-//
-// Deprecated: using IterBuffered() will get a better performence
-func (m ConcurrentMap[V]) Iter() <-chan Tuple[V] {
-	chans := snapshot(m)
-	ch := make(chan Tuple[V])
-	go fanIn(chans, ch)
-	return ch
+// MinBy returns the item with the smallest value according to less, and
+// false if the map is empty. Ties are resolved arbitrarily.
+func (m *ConcurrentMap[V]) MinBy(less func(a, b V) bool) (Tuple[V], bool) {
+	return m.MaxBy(func(a, b V) bool { return less(b, a) })
 }
 
-// IterBuffered returns a buffered iterator which could be used in a for range loop.
-func (m ConcurrentMap[V]) IterBuffered() <-chan Tuple[V] {
-	chans := snapshot(m)
-	total := 0
-	for _, c := range chans {
-		total += cap(c)
-	}
-	ch := make(chan Tuple[V], total)
-	go fanIn(chans, ch)
-	return ch
+// IterShardCb calls fn for every item of the shard at shardIndex while
+// holding its read lock. It panics if shardIndex is out of range.
+func (m *ConcurrentMap[V]) IterShardCb(shardIndex int, fn IterCb[V]) {
+	m.shardAt(shardIndex).ForEach(fn)
 }
 
-func (m ConcurrentMap[V]) PopAll() <-chan Tuple[V] {
-	chans := popAll(m)
-	total := 0
-	for _, c := range chans {
-		total += cap(c)
+// IterByShardIndex returns a closed channel buffered with the items of the
+// shard at shardIndex, read under its read lock, so shards can be
+// processed independently by the caller's own workers. It panics if
+// shardIndex is out of range.
+func (m *ConcurrentMap[V]) IterByShardIndex(shardIndex int) <-chan Tuple[V] {
+	shard := m.shardAt(shardIndex)
+	shard.rlock()
+	ch := make(chan Tuple[V], len(shard.items))
+	for key, val := range shard.items {
+		ch <- Tuple[V]{key, val}
 	}
-	ch := make(chan Tuple[V], total)
-	go fanIn(chans, ch)
+	shard.RUnlock()
+	close(ch)
 	return ch
 }
 
-// Clear removes all items from map.
-func (m ConcurrentMap[V]) Clear() {
-	for item := range m.IterBuffered() {
-		m.Remove(item.Key)
-	}
+// Reduce folds all items of m into a single value, starting from initial.
+// Shards are visited one after the other, each under its read lock, so fn
+// is never called concurrently and MUST NOT write to m.
+func Reduce[V, R any](m *ConcurrentMap[V], initial R, fn func(acc R, key string, val V) R) R {
+	acc := initial
+	m.IterCb(func(key string, v V) {
+		acc = fn(acc, key, v)
+	})
+	return acc
 }
 
-// Returns a array of channels that contains elements in each shard,
-// which likely takes a snapshot of `m`.
-// It returns once the size of each buffered channel is determined,
-// before all the channels are populated using goroutines.
-func snapshot[V any](m ConcurrentMap[V]) (chans []chan Tuple[V]) {
-	// When you access map items before initializing.
-	if len(m.shards) == 0 {
-		panic(`cmap.ConcurrentMap is not initialized. Should run New() before usage.`)
-	}
-	chans = make([]chan Tuple[V], m.shardCount)
+// GroupBy partitions the items of m by the value fn returns for them.
+// Shards are processed in parallel, one goroutine each, therefore fn must
+// be safe for concurrent use. Order within a group is unspecified.
+func GroupBy[V any, K comparable](m *ConcurrentMap[V], fn func(key string, val V) K) map[K][]Tuple[V] {
+	m.lazyInit()
+	groups := make(map[K][]Tuple[V])
+	mu := sync.Mutex{}
 	wg := sync.WaitGroup{}
 	wg.Add(m.shardCount)
-	// Foreach shard.
-	for index, shard := range m.shards {
-		go func(index int, shard *ConcurrentMapShared[V]) {
-			// Foreach key, value pair.
-			shard.RLock()
-			chans[index] = make(chan Tuple[V], len(shard.items))
-			wg.Done()
+	for _, shard := range m.shards {
+		go func(shard *ConcurrentMapShared[V]) {
+			defer wg.Done()
+			local := make(map[K][]Tuple[V])
+			shard.rlock()
 			for key, val := range shard.items {
-				chans[index] <- Tuple[V]{key, val}
+				group := fn(key, val)
+				local[group] = append(local[group], Tuple[V]{key, val})
 			}
 			shard.RUnlock()
-			close(chans[index])
-		}(index, shard)
+
+			mu.Lock()
+			for group, tuples := range local {
+				groups[group] = append(groups[group], tuples...)
+			}
+			mu.Unlock()
+		}(shard)
 	}
 	wg.Wait()
-	return chans
+	return groups
 }
 
-// Returns a array of channels that contains elements in each shard and clears the map.
-func popAll[V any](m ConcurrentMap[V]) (chans []chan Tuple[V]) {
-	// When you access map items before initializing.
-	if len(m.shards) == 0 {
-		panic(`cmap.ConcurrentMap is not initialized. Should run New() before usage.`)
-	}
-	chans = make([]chan Tuple[V], m.shardCount)
+// GroupByShardParallel calls agg once per shard, each in its own goroutine
+// with the shard's read lock held, and returns the results indexed by
+// shard. agg must be safe for concurrent use, MUST NOT modify items and
+// MUST NOT write to m.
+func GroupByShardParallel[V, A any](m *ConcurrentMap[V], agg func(shardIndex int, items map[string]V) A) []A {
+	m.lazyInit()
+	results := make([]A, m.shardCount)
 	wg := sync.WaitGroup{}
 	wg.Add(m.shardCount)
-	// Foreach shard.
 	for index, shard := range m.shards {
 		go func(index int, shard *ConcurrentMapShared[V]) {
-			// Foreach key, value pair.
-			shard.Lock()
-			chans[index] = make(chan Tuple[V], len(shard.items))
-			wg.Done()
-			for key, val := range shard.items {
-				chans[index] <- Tuple[V]{key, val}
-			}
-			close(chans[index])
-			shard.items = make(map[string]V)
-			shard.Unlock()
+			defer wg.Done()
+			shard.rlock()
+			defer shard.RUnlock()
+			results[index] = agg(index, shard.items)
 		}(index, shard)
 	}
 	wg.Wait()
-	return chans
+	return results
 }
 
-// fanIn reads elements from channels `chans` into channel `out`
-func fanIn[V any](chans []chan Tuple[V], out chan Tuple[V]) {
-	wg := sync.WaitGroup{}
-	wg.Add(len(chans))
-	for _, ch := range chans {
-		go func(ch chan Tuple[V]) {
-			for t := range ch {
-				out <- t
+// Merge returns a new map, created with the default options, holding the
+// entries of maps. Keys present in several maps get the value of the last
+// one, use MergeWith to choose otherwise. nil maps are skipped.
+func Merge[V any](maps ...*ConcurrentMap[V]) *ConcurrentMap[V] {
+	return MergeWith(nil, maps...)
+}
+
+// MergeWith is Merge calling resolve, when a key was already merged from
+// an earlier map, with the value merged so far and the incoming one to
+// pick the value to keep. A nil resolve makes the last writer win.
+// resolve is called while shards of the result and of the input are
+// locked and MUST NOT access them.
+func MergeWith[V any](resolve func(key string, a, b V) V, maps ...*ConcurrentMap[V]) *ConcurrentMap[V] {
+	out := New[V]()
+	for _, m := range maps {
+		if m == nil {
+			continue
+		}
+		m.IterCb(func(key string, v V) {
+			if resolve == nil {
+				out.MustSet(key, v)
+				return
 			}
-			wg.Done()
-		}(ch)
+			out.MustUpsert(key, v, func(exist bool, a V, b V) V {
+				if !exist {
+					return b
+				}
+				return resolve(key, a, b)
+			})
+		})
 	}
-	wg.Wait()
-	close(out)
+	return out
 }
 
-// Items returns all items as map[string]V
-func (m ConcurrentMap[V]) Items() map[string]V {
-	tmp := make(map[string]V)
+// Union returns a new map, created with the default options, holding the
+// keys of a and b. Keys present in both get resolve(key, va, vb), or the
+// value of b when resolve is nil. It is MergeWith for two maps.
+func Union[V any](a, b *ConcurrentMap[V], resolve func(key string, va, vb V) V) *ConcurrentMap[V] {
+	return MergeWith(resolve, a, b)
+}
 
-	// Insert items to temporary map.
-	for item := range m.IterBuffered() {
-		tmp[item.Key] = item.Val
+// Intersect returns a new map, created with the default options, holding
+// the entries of a whose key is also in b with a value eq reports equal,
+// eq being called with the values of a and b in that order. The smaller of
+// the two maps is copied then looked up in the larger one, so the result
+// is not a snapshot: entries written concurrently may or may not be seen.
+func Intersect[V any](a, b *ConcurrentMap[V], eq func(V, V) bool) *ConcurrentMap[V] {
+	out := New[V]()
+	small, large := a, b
+	if b.Count() < a.Count() {
+		small, large = b, a
 	}
-
-	return tmp
+	for key, v := range small.Items() {
+		other, ok := large.Get(key)
+		if !ok {
+			continue
+		}
+		av, bv := v, other
+		if small == b {
+			av, bv = other, v
+		}
+		if eq(av, bv) {
+			out.MustSet(key, av)
+		}
+	}
+	return out
 }
 
-// Iterator callbacalled for every key,value found in
-// maps. RLock is held for all calls for a given shard
-// therefore callback sess consistent view of a shard,
-// but not across the shards
-type IterCb[V any] func(key string, v V)
-
-// Callback based iterator, cheapest way to read
-// all elements in a map.
-func (m ConcurrentMap[V]) IterCb(fn IterCb[V]) {
-	for idx := range m.shards {
-		shard := (m.shards)[idx]
-		shard.RLock()
-		for key, value := range shard.items {
-			fn(key, value)
+// Subtract returns a new map, created with the default options, holding
+// the entries of a whose key is not in b, whatever its value there. Each
+// shard of a is copied under its read lock, which is released before
+// probing b, so a and b can safely be subtracted from each other
+// concurrently. The result is not a snapshot: entries written concurrently
+// may or may not be seen.
+func Subtract[V any](a, b *ConcurrentMap[V]) *ConcurrentMap[V] {
+	out := New[V]()
+	if a == b {
+		return out
+	}
+	a.lazyInit()
+	for _, shard := range a.shards {
+		shard.rlock()
+		tuples := make([]Tuple[V], 0, len(shard.items))
+		for key, val := range shard.items {
+			tuples = append(tuples, Tuple[V]{key, val})
 		}
 		shard.RUnlock()
+
+		for _, t := range tuples {
+			if !b.Has(t.Key) {
+				out.MustSet(t.Key, t.Val)
+			}
+		}
 	}
+	return out
 }
 
 // Keys returns all keys as []string
-func (m ConcurrentMap[V]) Keys() []string {
+func (m *ConcurrentMap[V]) Keys() []string {
+	m.lazyInit()
 	count := m.Count()
+	if m.frozen.Load() {
+		keys := make([]string, 0, count)
+		for _, shard := range m.shards {
+			for key := range shard.items {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	if m.sequential {
+		keys := make([]string, 0, count)
+		for _, shard := range m.shards {
+			shard.rlock()
+			for key := range shard.items {
+				keys = append(keys, key)
+			}
+			shard.RUnlock()
+		}
+		return keys
+	}
 	ch := make(chan string, count)
 	go func() {
 		// Foreach shard.
@@ -354,7 +2897,7 @@ func (m ConcurrentMap[V]) Keys() []string {
 		for _, shard := range m.shards {
 			go func(shard *ConcurrentMapShared[V]) {
 				// Foreach key, value pair.
-				shard.RLock()
+				shard.rlock()
 				for key := range shard.items {
 					ch <- key
 				}
@@ -374,8 +2917,95 @@ func (m ConcurrentMap[V]) Keys() []string {
 	return keys
 }
 
+// SortedKeys returns all keys in ascending order.
+func (m *ConcurrentMap[V]) SortedKeys() []string {
+	keys := m.Keys()
+	sort.Strings(keys)
+	return keys
+}
+
+// ForEachOrdered calls fn for every item in ascending key order, from a
+// single goroutine. Keys are listed first, then each value is read with its
+// own lock acquisition and no lock is held while fn runs, so items removed
+// in between are skipped and fn may access the map.
+func (m *ConcurrentMap[V]) ForEachOrdered(fn IterCb[V]) {
+	for _, key := range m.SortedKeys() {
+		if v, ok := m.Get(key); ok {
+			fn(key, v)
+		}
+	}
+}
+
+// IterPage returns up to pageSize items following cursor, together with
+// the cursor of the next page. An empty cursor starts from the beginning and
+// an empty next cursor means there are no more items; the last page may be
+// empty. Shards are walked in index order and keys in sorted order within a
+// shard, each shard being read under its read lock, so no lock is held
+// between calls. Items written behind the cursor are not returned, and a
+// malformed cursor yields no items.
+func (m *ConcurrentMap[V]) IterPage(cursor string, pageSize int) (entries []Tuple[V], nextCursor string) {
+	m.lazyInit()
+	start, after := 0, ""
+	resume := false
+	if cursor != "" {
+		index, key, ok := strings.Cut(cursor, ":")
+		n, err := strconv.Atoi(index)
+		if !ok || err != nil || n < 0 || n >= m.shardCount {
+			return nil, ""
+		}
+		start, after, resume = n, key, true
+	}
+	if pageSize <= 0 {
+		return nil, cursor
+	}
+
+	entries = make([]Tuple[V], 0, pageSize)
+	for index := start; index < m.shardCount; index++ {
+		shard := m.shards[index]
+		shard.rlock()
+		keys := make([]string, 0, len(shard.items))
+		for key := range shard.items {
+			if !resume || index != start || key > after {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entries = append(entries, Tuple[V]{key, shard.items[key]})
+			if len(entries) == pageSize {
+				shard.RUnlock()
+				return entries, strconv.Itoa(index) + ":" + key
+			}
+		}
+		shard.RUnlock()
+	}
+	return entries, ""
+}
+
+// AppendKeys appends all keys to dst and returns the extended slice.
+// Reusing dst across calls, as in dst = m.AppendKeys(dst[:0]), avoids
+// allocating a new slice every time.
+func (m *ConcurrentMap[V]) AppendKeys(dst []string) []string {
+	m.IterCb(func(key string, v V) {
+		dst = append(dst, key)
+	})
+	return dst
+}
+
+// AppendItems writes all items into dst, allocating it if nil, and returns it.
+// Existing entries of dst are kept unless m holds the same key.
+func (m *ConcurrentMap[V]) AppendItems(dst map[string]V) map[string]V {
+	if dst == nil {
+		dst = make(map[string]V, m.Count())
+	}
+	m.IterCb(func(key string, v V) {
+		dst[key] = v
+	})
+	return dst
+}
+
 // Reviles ConcurrentMap "private" variables to json marshal.
-func (m ConcurrentMap[V]) MarshalJSON() ([]byte, error) {
+func (m *ConcurrentMap[V]) MarshalJSON() ([]byte, error) {
 	// Create a temporary map, which will hold all item spread across shards.
 	tmp := make(map[string]V)
 
@@ -386,6 +3016,73 @@ func (m ConcurrentMap[V]) MarshalJSON() ([]byte, error) {
 	return json.Marshal(tmp)
 }
 
+// MarshalJSONPretty is MarshalJSON indented with two spaces, for config
+// dumps, debug endpoints and golden files. Keys are in sorted order, as
+// with MarshalJSON.
+func (m *ConcurrentMap[V]) MarshalJSONPretty() ([]byte, error) {
+	return json.MarshalIndent(m.Items(), "", "  ")
+}
+
+// MarshalJSONFiltered is MarshalJSON restricted to the entries for which
+// include returns true. include is called with the shards' read locks held
+// and MUST NOT write to m.
+func (m *ConcurrentMap[V]) MarshalJSONFiltered(include func(key string, v V) bool) ([]byte, error) {
+	tmp := make(map[string]V)
+	m.IterCb(func(key string, v V) {
+		if include(key, v) {
+			tmp[key] = v
+		}
+	})
+	return json.Marshal(tmp)
+}
+
+// String returns a short summary of the map like
+// ConcurrentMap[12 entries, 128 shards], or
+// ConcurrentMap(name)[12 entries, 128 shards] for maps created with NewTyped.
+// Its cost does not depend on the number of entries, use PrettyString to dump
+// them. The format is meant for debugging and may change, do not parse it.
+func (m *ConcurrentMap[V]) String() string {
+	m.lazyInit()
+	name := ""
+	if m.name != "" {
+		name = "(" + m.name + ")"
+	}
+	return fmt.Sprintf("ConcurrentMap%s[%d entries, %d shards]", name, m.Count(), m.shardCount)
+}
+
+// PrettyString returns all the entries as indented JSON, like
+// MarshalJSONPretty, or the marshalling error. Unlike String it lists
+// every entry, it is meant for debug dumps and its format may change.
+func (m *ConcurrentMap[V]) PrettyString() string {
+	b, err := m.MarshalJSONPretty()
+	if err != nil {
+		return m.prefix() + ": " + err.Error()
+	}
+	return string(b)
+}
+
+// GoString implements fmt.GoStringer for %#v, used by test failure
+// messages: it returns the constructor call of the map followed by one
+// Set line per entry, in sorted key order, with values printed with %#v.
+// All entries are printed. As with String, the format may change.
+func (m *ConcurrentMap[V]) GoString() string {
+	m.lazyInit()
+	items := m.Items()
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	typ := strings.TrimPrefix(fmt.Sprintf("%T", (*V)(nil)), "*")
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "cmap.New[%s](cmap.WithShardCount[%s](%d))", typ, typ, m.shardCount)
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "\nSet(%q, %#v)", key, items[key])
+	}
+	return sb.String()
+}
+
 func fnv64a(key string) uint64 {
 	var hash uint64 = 14695981039346656037
 	const prime64 = 1099511628211
@@ -408,7 +3105,192 @@ func (m *ConcurrentMap[V]) UnmarshalJSON(b []byte) (err error) {
 
 	// foreach key,value pair in temporary map insert into our concurrent map.
 	for key, val := range tmp {
-		m.Set(key, val)
+		if err := m.Set(key, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadJSON sets the entries of the JSON object read from r, decoding it
+// key by key so that only one value is held in memory at a time, unlike
+// UnmarshalJSON. Entries decoded before an error stay set.
+func (m *ConcurrentMap[V]) ReadJSON(r io.Reader) error {
+	err := m.readJSONObject(json.NewDecoder(r))
+	if err == io.EOF {
+		return fmt.Errorf("%s: read JSON: %w", m.prefix(), io.ErrUnexpectedEOF)
+	}
+	return err
+}
+
+// ReadJSONStream is ReadJSON for a stream of JSON objects, concatenated or
+// one per line, read until r is exhausted. Each pair is set as soon as it
+// is decoded, so memory stays proportional to the largest value. An empty
+// stream is not an error.
+func (m *ConcurrentMap[V]) ReadJSONStream(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		if err := m.readJSONObject(dec); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// readJSONObject decodes the next JSON object of dec entry by entry and
+// sets its entries. It returns io.EOF as is if dec has no more input
+// before the object starts.
+func (m *ConcurrentMap[V]) readJSONObject(dec *json.Decoder) error {
+	tok, err := dec.Token()
+	if err == io.EOF {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("%s: read JSON: %w", m.prefix(), err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("%s: read JSON: expected an object, got %v at offset %d", m.prefix(), tok, dec.InputOffset())
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("%s: read JSON: %w", m.prefix(), err)
+		}
+		key := tok.(string)
+		var val V
+		if err := dec.Decode(&val); err != nil {
+			return fmt.Errorf("%s: read JSON: value of key %q: %w", m.prefix(), key, err)
+		}
+		if err := m.Set(key, val); err != nil {
+			return err
+		}
+	}
+	// Consume the closing brace.
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("%s: read JSON: %w", m.prefix(), err)
+	}
+	return nil
+}
+
+// MergeFrom merges a stream of JSON objects read from r, typically one per
+// line, each object mapping keys to values. Only one object is held in
+// memory at a time. When a key is already present, resolve picks the value
+// to keep; incoming values win if resolve is nil. resolve is called while
+// the key's shard is locked and MUST NOT access the map.
+// Objects decoded before an error stay merged.
+func (m *ConcurrentMap[V]) MergeFrom(r io.Reader, resolve func(key string, existing, incoming V) V) error {
+	dec := json.NewDecoder(r)
+	for {
+		var obj map[string]V
+		if err := dec.Decode(&obj); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: merge: %w", m.prefix(), err)
+		}
+		for key, incoming := range obj {
+			_, err := m.Upsert(key, incoming, func(exist bool, existing V, incoming V) V {
+				if !exist || resolve == nil {
+					return incoming
+				}
+				return resolve(key, existing, incoming)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// MarshalXML encodes the map as <map><entry key="k">v</entry>...</map>,
+// with entries in sorted key order. V must itself be XML marshalable.
+// When the map is a struct field, the field's element name replaces map.
+func (m *ConcurrentMap[V]) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	items := m.Items()
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Generic type names such as ConcurrentMap[string] are not valid XML names.
+	if start.Name.Local == "" || strings.ContainsRune(start.Name.Local, '[') {
+		start.Name = xml.Name{Local: "map"}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		entry := xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: key}},
+		}
+		if err := e.EncodeElement(items[key], entry); err != nil {
+			return err
+		}
+	}
+	if err := e.EncodeToken(start.End()); err != nil {
+		return err
+	}
+	return e.Flush()
+}
+
+// Reverse process of MarshalXML.
+func (m *ConcurrentMap[V]) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "entry" {
+				if err := d.Skip(); err != nil {
+					return err
+				}
+				continue
+			}
+			var key string
+			for _, attr := range t.Attr {
+				if attr.Name.Local == "key" {
+					key = attr.Value
+				}
+			}
+			var val V
+			if err := d.DecodeElement(&val, &t); err != nil {
+				return err
+			}
+			if err := m.Set(key, val); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// MarshalYAML encodes the map as a plain YAML mapping.
+func (m *ConcurrentMap[V]) MarshalYAML() (interface{}, error) {
+	return m.Items(), nil
+}
+
+// Reverse process of MarshalYAML.
+func (m *ConcurrentMap[V]) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: cannot unmarshal YAML node of kind %v into ConcurrentMap", m.prefix(), value.Kind)
+	}
+	for i := 0; i+1 < len(value.Content); i += 2 {
+		var key string
+		if err := value.Content[i].Decode(&key); err != nil {
+			return err
+		}
+		var val V
+		if err := value.Content[i+1].Decode(&val); err != nil {
+			return err
+		}
+		if err := m.Set(key, val); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -1,9 +1,12 @@
 package cmap
 
 import (
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func BenchmarkItems(b *testing.B) {
@@ -604,3 +607,279 @@ func BenchmarkKeys(b *testing.B) {
 		m.Keys()
 	}
 }
+
+func BenchmarkBatchUpsert(b *testing.B) {
+	m := New[int]()
+	data := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		data[strconv.Itoa(i)] = i
+	}
+	cb := func(exists bool, valueInMap int, newValue int) int {
+		return valueInMap + newValue
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.BatchUpsert(data, cb)
+	}
+}
+
+func BenchmarkUpsertLoop(b *testing.B) {
+	m := New[int]()
+	data := make(map[string]int)
+	for i := 0; i < 10000; i++ {
+		data[strconv.Itoa(i)] = i
+	}
+	cb := func(exists bool, valueInMap int, newValue int) int {
+		return valueInMap + newValue
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for key, value := range data {
+			m.Upsert(key, value, cb)
+		}
+	}
+}
+
+func BenchmarkAppendKeys(b *testing.B) {
+	m := New[Animal]()
+
+	// Insert 10000 elements.
+	for i := 0; i < 10000; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	var keys []string
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		keys = m.AppendKeys(keys[:0])
+	}
+}
+
+func BenchmarkAppendItems(b *testing.B) {
+	m := New[Animal]()
+
+	// Insert 10000 elements.
+	for i := 0; i < 10000; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	items := make(map[string]Animal)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clear(items)
+		items = m.AppendItems(items)
+	}
+}
+
+func BenchmarkIsEmpty(b *testing.B) {
+	m := New[Animal]()
+	m.Set("elephant", Animal{"elephant"})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.IsEmpty()
+	}
+}
+
+func benchmarkSmallKeys(b *testing.B, opts ...Option[Animal]) {
+	m := New[Animal](opts...)
+	for i := 0; i < 10; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Keys()
+	}
+}
+
+func BenchmarkSmallKeysParallel(b *testing.B) {
+	benchmarkSmallKeys(b)
+}
+
+func BenchmarkSmallKeysSequential(b *testing.B) {
+	benchmarkSmallKeys(b, WithSequentialIteration[Animal]())
+}
+
+func benchmarkSmallItems(b *testing.B, opts ...Option[Animal]) {
+	m := New[Animal](opts...)
+	for i := 0; i < 10; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		m.Items()
+	}
+}
+
+func BenchmarkSmallItemsParallel(b *testing.B) {
+	benchmarkSmallItems(b)
+}
+
+func BenchmarkSmallItemsSequential(b *testing.B) {
+	benchmarkSmallItems(b, WithSequentialIteration[Animal]())
+}
+
+func benchmarkGetParallel(b *testing.B, freeze bool) {
+	m := New[Animal]()
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	if freeze {
+		m.Freeze()
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			m.Get(strconv.Itoa(i % 1000))
+			i++
+		}
+	})
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	benchmarkGetParallel(b, false)
+}
+
+func BenchmarkGetParallelFrozen(b *testing.B) {
+	benchmarkGetParallel(b, true)
+}
+
+// benchmarkReadHeavyGetOrSet runs a get-or-set pattern on a map where
+// almost every key is present, and reports the write locked sections per
+// operation seen by the lock tracer.
+func benchmarkReadHeavyGetOrSet(b *testing.B, getOrSet func(m *ConcurrentMap[int], key string)) {
+	var writeLocks atomic.Int64
+	m := New[int](WithLockTracer[int](func(string, string, time.Duration) {
+		writeLocks.Add(1)
+	}))
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	writeLocks.Store(0)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			// Only the keys from 1000 on miss, until first stored.
+			getOrSet(m, strconv.Itoa(i%1010))
+			i++
+		}
+	})
+	b.ReportMetric(float64(writeLocks.Load())/float64(b.N), "writelocks/op")
+}
+
+func BenchmarkReadHeavyGetOrSet(b *testing.B) {
+	benchmarkReadHeavyGetOrSet(b, func(m *ConcurrentMap[int], key string) {
+		m.GetOrSet(key, 0)
+	})
+}
+
+func BenchmarkReadHeavyUpsert(b *testing.B) {
+	benchmarkReadHeavyGetOrSet(b, func(m *ConcurrentMap[int], key string) {
+		m.Upsert(key, 0, func(exist bool, valueInMap, newValue int) int {
+			if exist {
+				return valueInMap
+			}
+			return newValue
+		})
+	})
+}
+
+func benchmarkFill(b *testing.B, opts ...Option[int]) {
+	for i := 0; i < b.N; i++ {
+		m := New[int](append(opts, WithShardCount[int](16))...)
+		for j := 0; j < 10000; j++ {
+			m.Set(strconv.Itoa(j), j)
+		}
+	}
+}
+
+func BenchmarkFill(b *testing.B) {
+	benchmarkFill(b)
+}
+
+func BenchmarkFillWithCapacityPerShard(b *testing.B) {
+	benchmarkFill(b, WithCapacityPerShard[int](10000/16))
+}
+
+// BenchmarkShrink reports the heap held by a map emptied down to 1% of its
+// peak size, before and after Shrink.
+func BenchmarkShrink(b *testing.B) {
+	heap := func() uint64 {
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+	var before, after uint64
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		m := New[int](WithShardCount[int](16))
+		for j := 0; j < 100000; j++ {
+			m.Set(strconv.Itoa(j), j)
+		}
+		for j := 1000; j < 100000; j++ {
+			m.Remove(strconv.Itoa(j))
+		}
+		base := heap()
+		b.StartTimer()
+		m.Shrink()
+		b.StopTimer()
+		shrunk := heap()
+		before += base
+		after += shrunk
+		runtime.KeepAlive(m)
+	}
+	b.ReportMetric(float64(before)/float64(b.N), "heap-before-B")
+	b.ReportMetric(float64(after)/float64(b.N), "heap-after-B")
+}
+
+// The ReadMostly benchmarks compare the map with sync.Map on a 99% read
+// workload over 1000 keys.
+func BenchmarkReadMostly(b *testing.B) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	m := New[int]()
+	for i, key := range keys {
+		m.Set(key, i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%100 == 0 {
+				m.Set(key, i)
+			} else {
+				m.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkReadMostlySyncMap(b *testing.B) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	var m sync.Map
+	for i, key := range keys {
+		m.Store(key, i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := keys[i%len(keys)]
+			if i%100 == 0 {
+				m.Store(key, i)
+			} else {
+				m.Load(key)
+			}
+			i++
+		}
+	})
+}
@@ -1,11 +1,23 @@
 package cmap
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type Animal struct {
@@ -676,3 +688,3023 @@ func TestUnDrainedIterBuffered(t *testing.T) {
 		t.Error("We should have counted 200 elements.")
 	}
 }
+
+func TestBatchUpsert(t *testing.T) {
+	cb := func(exists bool, valueInMap int, newValue int) int {
+		if !exists {
+			return newValue
+		}
+		return valueInMap + newValue
+	}
+
+	data := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		data[strconv.Itoa(i)] = i
+	}
+
+	batch := New[int]()
+	loop := New[int]()
+	for i := 0; i < 100; i++ {
+		batch.Set(strconv.Itoa(i), 1000)
+		loop.Set(strconv.Itoa(i), 1000)
+	}
+
+	batch.BatchUpsert(data, cb)
+	for key, value := range data {
+		loop.Upsert(key, value, cb)
+	}
+
+	if batch.Count() != 200 {
+		t.Error("map should contain exactly 200 elements.")
+	}
+
+	for key, expected := range loop.Items() {
+		if v, ok := batch.Get(key); !ok || v != expected {
+			t.Errorf("BatchUpsert stored %d under %s, Upsert stored %d", v, key, expected)
+		}
+	}
+}
+
+func TestWithInitialData(t *testing.T) {
+	data := map[string]Animal{
+		"elephant": {"elephant"},
+		"monkey":   {"monkey"},
+	}
+	m := New[Animal](WithInitialData(data), WithShardCount[Animal](4))
+
+	if m.Count() != 2 {
+		t.Error("map should contain exactly two elements.")
+	}
+
+	for key, expected := range data {
+		if v, ok := m.Get(key); !ok || v != expected {
+			t.Errorf("expected %v under %s, got %v", expected, key, v)
+		}
+	}
+}
+
+func TestDispose(t *testing.T) {
+	m := New[Animal]()
+	m.Set("elephant", Animal{"elephant"})
+
+	m.Dispose()
+	// Dispose must be idempotent.
+	m.Dispose()
+
+	select {
+	case <-m.life.done:
+	default:
+		t.Error("Dispose should signal background goroutines to stop.")
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	data := map[string]Animal{
+		"elephant": {"elephant"},
+		"monkey":   {"monkey"},
+	}
+	m := FromMap(data, WithShardCount[Animal](8))
+
+	if m.Count() != 2 {
+		t.Error("map should contain exactly two elements.")
+	}
+
+	// Mutating the source map must not affect the concurrent map.
+	data["tiger"] = Animal{"tiger"}
+	data["elephant"] = Animal{"dolphin"}
+	delete(data, "monkey")
+
+	if m.Has("tiger") {
+		t.Error("key added to the source map leaked into the concurrent map.")
+	}
+	if v, _ := m.Get("elephant"); v.name != "elephant" {
+		t.Error("value changed in the source map leaked into the concurrent map.")
+	}
+	if !m.Has("monkey") {
+		t.Error("key removed from the source map was removed from the concurrent map.")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := New[Animal](WithMetrics[Animal]())
+
+	m.Set("elephant", Animal{"elephant"})
+	m.Set("monkey", Animal{"monkey"})
+	m.Get("elephant")
+	m.Get("monkey")
+	m.Get("tiger")
+	m.Remove("monkey")
+	m.Get("monkey")
+
+	expected := MapMetrics{Hits: 2, Misses: 2, Sets: 2, Removes: 1}
+	if metrics := m.Metrics(); metrics != expected {
+		t.Errorf("expected metrics %+v, got %+v", expected, metrics)
+	}
+
+	// Metrics are disabled by default.
+	m = New[Animal]()
+	m.Set("elephant", Animal{"elephant"})
+	m.Get("elephant")
+	if metrics := m.Metrics(); metrics != (MapMetrics{}) {
+		t.Errorf("expected zero metrics, got %+v", metrics)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	eq := func(a, b Animal) bool { return a == b }
+
+	a := New[Animal]()
+	b := New[Animal](WithShardCount[Animal](4))
+	if !a.Equal(b, eq) {
+		t.Error("empty maps should be equal.")
+	}
+
+	for i := 0; i < 100; i++ {
+		a.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+		b.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	if !a.Equal(b, eq) || !b.Equal(a, eq) {
+		t.Error("maps with the same items should be equal.")
+	}
+	if !a.Equal(a, eq) {
+		t.Error("map should be equal to itself.")
+	}
+
+	b.Set("42", Animal{"tiger"})
+	if a.Equal(b, eq) {
+		t.Error("maps with different values should not be equal.")
+	}
+
+	b.Set("42", Animal{"42"})
+	b.Set("100", Animal{"100"})
+	if a.Equal(b, eq) || b.Equal(a, eq) {
+		t.Error("maps with different keys should not be equal.")
+	}
+}
+
+func TestIsDisposed(t *testing.T) {
+	m := New[Animal]()
+	m.Set("elephant", Animal{"elephant"})
+
+	if m.IsDisposed() {
+		t.Error("new map should not be disposed.")
+	}
+
+	m.Dispose()
+	if !m.IsDisposed() {
+		t.Error("map should be disposed after Dispose.")
+	}
+
+	// Reads behave as on an empty map.
+	if _, ok := m.Get("elephant"); ok {
+		t.Error("disposed map should not return items.")
+	}
+	if m.Count() != 0 {
+		t.Error("disposed map should be empty.")
+	}
+
+	// Writes fail, or panic when they cannot return an error.
+	if err := m.Set("monkey", Animal{"monkey"}); !errors.Is(err, ErrDisposed) {
+		t.Errorf("expected ErrDisposed, got %v", err)
+	}
+	if err := m.Remove("elephant"); !errors.Is(err, ErrDisposed) {
+		t.Errorf("expected ErrDisposed, got %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("writing to a disposed map should panic.")
+		}
+	}()
+	m.MustSet("monkey", Animal{"monkey"})
+}
+
+func TestString(t *testing.T) {
+	m := New[int]()
+	if s := m.String(); s != "ConcurrentMap[0 entries, 128 shards]" {
+		t.Errorf("unexpected output for an empty map: %s", s)
+	}
+
+	m.Set("b", 2)
+	m.Set("a", 1)
+	m.Set("c", 3)
+	if s := fmt.Sprint(m); s != "ConcurrentMap[3 entries, 128 shards]" {
+		t.Errorf("unexpected output: %s", s)
+	}
+
+	m = New[int](WithShardCount[int](4))
+	for i := 0; i < 100; i++ {
+		m.Set(fmt.Sprintf("%03d", i), i)
+	}
+	if s := m.String(); s != "ConcurrentMap[100 entries, 4 shards]" {
+		t.Errorf("unexpected output: %s", s)
+	}
+
+	var zero ConcurrentMap[int]
+	done := make(chan struct{})
+	go func() {
+		zero.Set("a", 1)
+		close(done)
+	}()
+	if s := zero.String(); s != "ConcurrentMap[0 entries, 128 shards]" && s != "ConcurrentMap[1 entries, 128 shards]" {
+		t.Errorf("unexpected output for a zero value map: %s", s)
+	}
+	<-done
+}
+
+func TestWithAutoDispose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := New[Animal](WithAutoDispose[Animal](ctx))
+	m.Set("elephant", Animal{"elephant"})
+
+	if m.IsDisposed() {
+		t.Error("map should not be disposed before the context is cancelled.")
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for !m.IsDisposed() {
+		if time.Now().After(deadline) {
+			t.Fatal("map should be disposed once the context is cancelled.")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestZeroValueMap(t *testing.T) {
+	var m ConcurrentMap[Animal]
+
+	if _, ok := m.Get("elephant"); ok {
+		t.Error("zero value map should behave as empty.")
+	}
+	if m.Count() != 0 {
+		t.Error("zero value map should be empty.")
+	}
+
+	m.Set("elephant", Animal{"elephant"})
+	if v, ok := m.Get("elephant"); !ok || v.name != "elephant" {
+		t.Error("zero value map should store items.")
+	}
+	if m.Count() != 1 {
+		t.Error("map should contain exactly one element.")
+	}
+	if m.shardCount != SHARD_COUNT {
+		t.Error("zero value map should be initialized with the default shard count.")
+	}
+}
+
+func TestEntries(t *testing.T) {
+	m := New[Animal]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	entries := m.Entries()
+	if len(entries) != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+	for _, entry := range entries {
+		if entry.Key != entry.Val.name {
+			t.Errorf("entry %s holds the wrong value %v", entry.Key, entry.Val)
+		}
+	}
+}
+
+func TestSubset(t *testing.T) {
+	eq := func(a, b Animal) bool { return a == b }
+
+	a := New[Animal]()
+	b := New[Animal]()
+	if !a.Subset(b, eq) {
+		t.Error("empty map should be a subset of an empty map.")
+	}
+
+	for i := 0; i < 100; i++ {
+		b.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	for i := 0; i < 50; i++ {
+		a.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+	if !a.Subset(b, eq) {
+		t.Error("a should be a subset of b.")
+	}
+	if b.Subset(a, eq) {
+		t.Error("b should not be a subset of a.")
+	}
+
+	a.Set("42", Animal{"tiger"})
+	if a.Subset(b, eq) {
+		t.Error("a holds a different value and should not be a subset of b.")
+	}
+}
+
+func TestWithHasher(t *testing.T) {
+	m := New[int](WithHasher[int](fnv.New64a))
+	builtin := New[int]()
+
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		m.Set(key, i)
+		builtin.Set(key, i)
+		if m.shardIndex(key) != builtin.shardIndex(key) {
+			t.Errorf("key %s should land in the same shard as with the built-in fnv64a", key)
+		}
+	}
+
+	for i := range m.shards {
+		if len(m.shards[i].items) != len(builtin.shards[i].items) {
+			t.Errorf("shard %d holds %d items, expected %d", i, len(m.shards[i].items), len(builtin.shards[i].items))
+		}
+	}
+}
+
+func TestNewLockedShard(t *testing.T) {
+	shard := NewLockedShard[Animal](16)
+	if shard.Len() != 0 {
+		t.Fatal("new shard should be empty.")
+	}
+
+	shard.Set("elephant", Animal{"elephant"})
+	shard.Set("monkey", Animal{"monkey"})
+	if v, ok := shard.Get("elephant"); !ok || v.name != "elephant" {
+		t.Errorf("expected the elephant, got %v, %v", v, ok)
+	}
+	if _, ok := shard.Get("tiger"); ok {
+		t.Error("missing keys should not be found.")
+	}
+	if v, ok := shard.Remove("monkey"); !ok || v.name != "monkey" {
+		t.Errorf("expected the removed monkey, got %v, %v", v, ok)
+	}
+	if _, ok := shard.Remove("monkey"); ok {
+		t.Error("removing a missing key should report false.")
+	}
+
+	var keys []string
+	shard.ForEach(func(key string, v Animal) {
+		keys = append(keys, key)
+	})
+	if shard.Len() != 1 || len(keys) != 1 || keys[0] != "elephant" {
+		t.Errorf("shard should contain only the elephant, got %v", keys)
+	}
+}
+
+func TestXmlMarshal(t *testing.T) {
+	m := New[string]()
+	m.Set("b", "2")
+	m.Set("a", "1")
+
+	expected := `<map><entry key="a">1</entry><entry key="b">2</entry></map>`
+	x, err := xml.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(x) != expected {
+		t.Error("xml", string(x), "differ from expected", expected)
+	}
+
+	other := New[string]()
+	if err := xml.Unmarshal(x, other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Count() != 2 {
+		t.Error("map should contain exactly two elements.")
+	}
+	if v, _ := other.Get("a"); v != "1" {
+		t.Error("value of a was not decoded.")
+	}
+}
+
+func TestXmlMarshalStruct(t *testing.T) {
+	type Pet struct {
+		Name string `xml:"name"`
+		Legs int    `xml:"legs,attr"`
+	}
+
+	m := New[Pet]()
+	m.Set("dog", Pet{"rex", 4})
+	m.Set("bird", Pet{"tweety", 2})
+
+	x, err := xml.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := New[Pet]()
+	if err := xml.Unmarshal(x, other); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Equal(other, func(a, b Pet) bool { return a == b }) {
+		t.Error("round trip through xml changed the map:", string(x))
+	}
+}
+
+func TestYamlMarshal(t *testing.T) {
+	m := New[int]()
+	m.Set("b", 2)
+	m.Set("a", 1)
+
+	expected := "a: 1\nb: 2\n"
+	y, err := yaml.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(y) != expected {
+		t.Error("yaml", string(y), "differ from expected", expected)
+	}
+
+	other := New[int]()
+	if err := yaml.Unmarshal(y, other); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Equal(other, func(a, b int) bool { return a == b }) {
+		t.Error("round trip through yaml changed the map.")
+	}
+
+	if err := yaml.Unmarshal([]byte("- 1\n- 2\n"), other); err == nil {
+		t.Error("unmarshaling a sequence should fail.")
+	}
+}
+
+func TestShardForEach(t *testing.T) {
+	m := New[Animal]()
+	m.Set("elephant", Animal{"elephant"})
+	m.Set("monkey", Animal{"monkey"})
+
+	seen := make(map[string]Animal)
+	m.GetShard("elephant").ForEach(func(key string, v Animal) {
+		seen[key] = v
+	})
+	if seen["elephant"].name != "elephant" {
+		t.Error("ForEach should visit the items of the shard.")
+	}
+	for key := range seen {
+		if m.GetShard(key) != m.GetShard("elephant") {
+			t.Errorf("ForEach visited %s from another shard", key)
+		}
+	}
+}
+
+func TestWithSeededHasher(t *testing.T) {
+	a := New[int](WithSeededHasher[int]())
+	b := New[int](WithSeededHasher[int]())
+
+	differ := 0
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		a.Set(key, i)
+		if a.shardIndex(key) != b.shardIndex(key) {
+			differ++
+		}
+	}
+	if differ == 0 {
+		t.Error("maps with different seeds should distribute keys differently.")
+	}
+	if v, ok := a.Get("42"); !ok || v != 42 {
+		t.Error("seeded map should retrieve stored items.")
+	}
+}
+
+func TestWithShardReadWrite(t *testing.T) {
+	m := New[int]()
+
+	// Find two keys living in the same shard.
+	from := "0"
+	to := ""
+	for i := 1; to == ""; i++ {
+		if key := strconv.Itoa(i); m.GetShard(key) == m.GetShard(from) {
+			to = key
+		}
+	}
+	m.Set(from, 100)
+	m.Set(to, 0)
+
+	// Move a balance between both keys atomically.
+	m.WithShardWrite(from, func(items map[string]int) {
+		items[from] -= 30
+		items[to] += 30
+	})
+
+	m.WithShardRead(to, func(items map[string]int) {
+		if items[from] != 70 || items[to] != 30 {
+			t.Errorf("unexpected balances %d and %d", items[from], items[to])
+		}
+		if items[from]+items[to] != 100 {
+			t.Error("total balance should be preserved.")
+		}
+	})
+}
+
+func TestShardLen(t *testing.T) {
+	m := New[Animal](WithShardCount[Animal](4))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), Animal{strconv.Itoa(i)})
+	}
+
+	total := 0
+	for _, shard := range m.shards {
+		total += shard.Len()
+	}
+	if total != 100 {
+		t.Error("shard lengths should add up to 100 elements.")
+	}
+	if NewLockedShard[Animal](8).Len() != 0 {
+		t.Error("new shard should be empty.")
+	}
+}
+
+func TestReduce(t *testing.T) {
+	m := New[int]()
+	for i := 1; i <= 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	sum := Reduce(m, 0, func(acc int, key string, val int) int {
+		return acc + val
+	})
+	if sum != 5050 {
+		t.Errorf("expected sum 5050, got %d", sum)
+	}
+
+	longest := Reduce(m, "", func(acc string, key string, val int) string {
+		if len(key) > len(acc) {
+			return key
+		}
+		return acc
+	})
+	if longest != "100" {
+		t.Errorf("expected longest key 100, got %s", longest)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	groups := GroupBy(m, func(key string, val int) bool {
+		return val%2 == 0
+	})
+	if len(groups) != 2 || len(groups[true]) != 50 || len(groups[false]) != 50 {
+		t.Fatal("expected two groups of 50 elements.")
+	}
+	for _, tuple := range groups[true] {
+		if tuple.Val%2 != 0 {
+			t.Errorf("odd value %d grouped as even", tuple.Val)
+		}
+	}
+}
+
+func TestOptions(t *testing.T) {
+	opts := New[int]().Options()
+	if opts.ShardCount != SHARD_COUNT || opts.Metrics {
+		t.Errorf("unexpected default options %+v", opts)
+	}
+	if opts.ShardingFunc("ABC") != fnv64a("ABC") {
+		t.Error("default sharding function should be fnv64a.")
+	}
+
+	sharding := func(key string) uint64 { return uint64(len(key)) }
+	opts = New[int](WithShardCount[int](8), WithShardingFunction[int](sharding), WithMetrics[int]()).Options()
+	if opts.ShardCount != 8 || !opts.Metrics {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if opts.ShardingFunc("ABC") != 3 {
+		t.Error("custom sharding function should be reported.")
+	}
+
+	log := NewMemoryMutationLog[int](1)
+	opts = New[int](
+		WithCapacityPerShard[int](16),
+		WithDebug[int](),
+		WithSequentialIteration[int](),
+		WithSyncAfterWrite[int](),
+		WithChangeStreamBuffer[int](8),
+		WithKeyTransformer[int](strings.ToLower),
+		WithKeyValidator[int](func(string) error { return nil }),
+		WithOnEvict[int](func(string, int) {}),
+		WithLockTracer[int](func(string, string, time.Duration) {}),
+		WithMutationLog[int](log),
+	).Options()
+	if opts.CapacityPerShard != 16 || !opts.Debug || !opts.SequentialIteration || !opts.SyncAfterWrite || opts.ChangeStreamBuffer != 8 {
+		t.Errorf("unexpected options %+v", opts)
+	}
+	if opts.KeyTransformer == nil || opts.KeyValidator == nil || opts.OnEvict == nil || opts.LockTracer == nil || opts.MutationLog != log {
+		t.Error("the functions given to the options should be reported.")
+	}
+}
+
+func TestPopIf(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	popped := m.PopIf(func(key string, v int) bool {
+		return v < 10
+	})
+	if len(popped) != 10 {
+		t.Errorf("expected 10 popped elements, got %d", len(popped))
+	}
+	for key, v := range popped {
+		if v >= 10 || m.Has(key) {
+			t.Errorf("%s should have been popped and removed", key)
+		}
+	}
+	if m.Count() != 90 {
+		t.Error("non matching elements should stay in the map.")
+	}
+}
+
+func TestClone(t *testing.T) {
+	m := New[int](WithShardCount[int](8), WithSeededHasher[int]())
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	c := m.Clone()
+	if c.shardCount != 8 {
+		t.Error("clone should preserve the shard count.")
+	}
+	if !c.Equal(m, func(a, b int) bool { return a == b }) {
+		t.Error("clone should hold the same items.")
+	}
+
+	c.Set("0", 42)
+	c.Remove("1")
+	if v, _ := m.Get("0"); v != 0 || !m.Has("1") {
+		t.Error("writes to the clone should not affect the original.")
+	}
+	if c.Options().Metrics {
+		t.Error("clone should not enable metrics without WithCloneOptions.")
+	}
+
+	m = New[int](WithKeyTransformer[int](strings.ToLower))
+	m.Set("FOO", 1)
+	if !m.Clone().Has("FOO") {
+		t.Error("clone should normalize keys like the original.")
+	}
+}
+
+func TestCloneWithCloneOptions(t *testing.T) {
+	m := New[int](WithCloneOptions[int](), WithMetrics[int](), WithInitialData(map[string]int{"a": 1, "b": 2}))
+	m.Remove("a")
+
+	c := m.Clone()
+	if !c.Options().Metrics {
+		t.Error("clone should preserve all options.")
+	}
+	if c.Has("a") || c.Count() != 1 {
+		t.Error("clone should hold the current items, not the initial data.")
+	}
+}
+
+func TestSample(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	sample := m.Sample(10)
+	if len(sample) != 10 {
+		t.Fatalf("expected 10 sampled elements, got %d", len(sample))
+	}
+	seen := make(map[string]bool)
+	for _, tuple := range sample {
+		if v, ok := m.Get(tuple.Key); !ok || v != tuple.Val {
+			t.Errorf("sampled entry %v is not in the map", tuple)
+		}
+		if seen[tuple.Key] {
+			t.Errorf("%s was sampled twice", tuple.Key)
+		}
+		seen[tuple.Key] = true
+	}
+
+	if len(m.Sample(1000)) != 100 {
+		t.Error("sampling more than the map holds should return all elements.")
+	}
+	if len(m.Sample(0)) != 0 {
+		t.Error("sampling zero elements should return nothing.")
+	}
+}
+
+func TestSampleWithRandSource(t *testing.T) {
+	sample := func() []Tuple[int] {
+		m := New[int](WithRandSource[int](rand.New(rand.NewSource(42))), WithShardCount[int](1))
+		for i := 0; i < 100; i++ {
+			m.Set(strconv.Itoa(i), i)
+		}
+		return m.Sample(5)
+	}
+
+	a, b := sample(), sample()
+	sort.Slice(a, func(i, j int) bool { return a[i].Key < a[j].Key })
+	sort.Slice(b, func(i, j int) bool { return b[i].Key < b[j].Key })
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatal("samples drawn from the same seed should be equal.")
+		}
+	}
+}
+
+func TestForEachBatch(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 105; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	var sizes []int
+	seen := make(map[string]bool)
+	err := m.ForEachBatch(10, func(batch []Tuple[int]) error {
+		sizes = append(sizes, len(batch))
+		for _, tuple := range batch {
+			seen[tuple.Key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 11 || sizes[10] != 5 {
+		t.Fatalf("expected 10 full batches and one of 5, got %v", sizes)
+	}
+	for _, size := range sizes[:10] {
+		if size != 10 {
+			t.Fatalf("expected full batches of 10, got %v", sizes)
+		}
+	}
+	if len(seen) != 105 {
+		t.Error("every element should be visited once.")
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	err = m.ForEachBatch(10, func(batch []Tuple[int]) error {
+		calls++
+		return errStop
+	})
+	if err != errStop || calls != 1 {
+		t.Error("iteration should stop at the first error.")
+	}
+
+	if m.ForEachBatch(0, func([]Tuple[int]) error { return nil }) == nil {
+		t.Error("a batch size of zero should be rejected.")
+	}
+}
+
+func TestAppendKeysItems(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	keys := m.AppendKeys([]string{"existing"})
+	if len(keys) != 101 || keys[0] != "existing" {
+		t.Error("AppendKeys should append to the given slice.")
+	}
+	keys = m.AppendKeys(keys[:0])
+	sort.Strings(keys)
+	expected := m.Keys()
+	sort.Strings(expected)
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Error("AppendKeys should return the same keys as Keys.")
+	}
+
+	items := m.AppendItems(map[string]int{"existing": -1})
+	if len(items) != 101 || items["existing"] != -1 || items["42"] != 42 {
+		t.Error("AppendItems should write into the given map.")
+	}
+	if len(m.AppendItems(nil)) != 100 {
+		t.Error("AppendItems should allocate a map when given nil.")
+	}
+}
+
+func TestMaxByMinBy(t *testing.T) {
+	less := func(a, b int) bool { return a < b }
+
+	m := New[int]()
+	if _, ok := m.MaxBy(less); ok {
+		t.Error("MaxBy should report an empty map.")
+	}
+	if _, ok := m.MinBy(less); ok {
+		t.Error("MinBy should report an empty map.")
+	}
+
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), (i*37)%100)
+	}
+	if max, ok := m.MaxBy(less); !ok || max.Val != 99 || max.Key != "27" {
+		t.Errorf("unexpected maximum %v", max)
+	}
+	if min, ok := m.MinBy(less); !ok || min.Val != 0 || min.Key != "0" {
+		t.Errorf("unexpected minimum %v", min)
+	}
+}
+
+func TestSelectByShard(t *testing.T) {
+	m := New[int](WithShardCount[int](8))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	a, b := m.ShardOf("1"), m.ShardOf("2")
+	entries := m.SelectByShard(a, b)
+	expected := m.shards[a].Len()
+	if a != b {
+		expected += m.shards[b].Len()
+	}
+	if len(entries) != expected {
+		t.Errorf("expected %d entries, got %d", expected, len(entries))
+	}
+	for _, entry := range entries {
+		if shard := m.ShardOf(entry.Key); shard != a && shard != b {
+			t.Errorf("%s belongs to another shard", entry.Key)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("an out of range shard index should panic.")
+		}
+	}()
+	m.SelectByShard(8)
+}
+
+func TestIterPage(t *testing.T) {
+	m := New[int](WithShardCount[int](8))
+	for i := 0; i < 105; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	seen := make(map[string]bool)
+	cursor := ""
+	pages := 0
+	for {
+		entries, next := m.IterPage(cursor, 10)
+		pages++
+		if len(entries) > 10 {
+			t.Fatalf("page holds %d entries", len(entries))
+		}
+		for _, entry := range entries {
+			if seen[entry.Key] {
+				t.Errorf("%s returned twice", entry.Key)
+			}
+			seen[entry.Key] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if len(seen) != 105 {
+		t.Errorf("expected 105 entries over all pages, got %d", len(seen))
+	}
+	if pages != 11 {
+		t.Errorf("expected 11 pages, got %d", pages)
+	}
+
+	if entries, next := m.IterPage("garbage", 10); len(entries) != 0 || next != "" {
+		t.Error("a malformed cursor should yield no entries.")
+	}
+}
+
+func TestNewWithError(t *testing.T) {
+	m, err := NewWithError[int](WithShardCount[int](16))
+	if err != nil || m.shardCount != 16 {
+		t.Fatalf("valid options should not fail: %v", err)
+	}
+
+	if _, err := NewWithError[int](WithShardCount[int](0)); err != ErrShardCountNotPositive {
+		t.Errorf("expected ErrShardCountNotPositive, got %v", err)
+	}
+	if _, err := NewWithError[int](WithShardCount[int](-4)); err != ErrShardCountNotPositive {
+		t.Errorf("expected ErrShardCountNotPositive, got %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r != ErrShardCountNotPositive {
+			t.Errorf("New should panic with the option error, got %v", r)
+		}
+	}()
+	New[int](WithShardCount[int](0))
+}
+
+func TestNewTyped(t *testing.T) {
+	m := NewTyped[int]("sessions", WithMetrics[int]())
+	m.Set("a", 1)
+
+	if s := m.String(); s != "ConcurrentMap(sessions)[1 entries, 128 shards]" {
+		t.Errorf("unexpected output: %s", s)
+	}
+	if m.Metrics().Name != "sessions" || m.Options().Name != "sessions" {
+		t.Error("name should be reported in metrics and options.")
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "sessions") {
+				t.Errorf("panic message should name the map, got %v", r)
+			}
+		}()
+		NewTyped[int]("sessions", WithShardCount[int](0))
+	}()
+
+	_, err := NewWithError(func(cm *ConcurrentMap[int]) { cm.name = "users" }, WithShardCount[int](0))
+	if !errors.Is(err, ErrShardCountNotPositive) || !strings.Contains(err.Error(), "users") {
+		t.Errorf("error should wrap the sentinel and name the map, got %v", err)
+	}
+}
+
+func TestIterShardCb(t *testing.T) {
+	m := New[int](WithShardCount[int](4))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	total := 0
+	for index := 0; index < 4; index++ {
+		m.IterShardCb(index, func(key string, v int) {
+			if m.ShardOf(key) != index {
+				t.Errorf("%s does not belong to shard %d", key, index)
+			}
+			total++
+		})
+	}
+	if total != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("an out of range shard index should panic.")
+		}
+	}()
+	m.IterShardCb(-1, func(string, int) {})
+}
+
+func TestNonPowerOfTwoShardCount(t *testing.T) {
+	for _, shardCount := range []int{1, 3, 7, 100} {
+		m := New[int](WithShardCount[int](shardCount))
+		for i := 0; i < 1000; i++ {
+			m.Set(strconv.Itoa(i), i)
+		}
+
+		if m.Count() != 1000 {
+			t.Errorf("%d shards: expected 1000 elements, got %d", shardCount, m.Count())
+		}
+		for i := 0; i < 1000; i++ {
+			if v, ok := m.Get(strconv.Itoa(i)); !ok || v != i {
+				t.Errorf("%d shards: could not retrieve %d", shardCount, i)
+			}
+		}
+		for index, shard := range m.shards {
+			if shardCount > 1 && shard.Len() == 0 {
+				t.Errorf("%d shards: shard %d is empty", shardCount, index)
+			}
+		}
+	}
+}
+
+// scanCount counts the items of m shard by shard, the ground truth the
+// atomic count is checked against.
+func scanCount[V any](m *ConcurrentMap[V]) int {
+	count := 0
+	for _, shard := range m.shards {
+		count += shard.Len()
+	}
+	return count
+}
+
+func TestRemoveAndCheckEmpty(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 1)
+	m.Set("b", 2)
+
+	if removed, empty := m.RemoveAndCheckEmpty("a"); !removed || empty {
+		t.Error("removing a should not empty the map.")
+	}
+	if removed, empty := m.RemoveAndCheckEmpty("a"); removed || empty {
+		t.Error("a should already be removed.")
+	}
+	if removed, empty := m.RemoveAndCheckEmpty("b"); !removed || !empty {
+		t.Error("removing b should empty the map.")
+	}
+	if m.Len() != 0 || !m.IsEmpty() {
+		t.Error("map should be empty.")
+	}
+}
+
+func TestConcurrentCount(t *testing.T) {
+	m := New[int](WithShardCount[int](4))
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := strconv.Itoa(i % 50)
+				switch (w + i) % 5 {
+				case 0:
+					m.Set(key, i)
+				case 1:
+					m.SetIfAbsent(key, i)
+				case 2:
+					m.Remove(key)
+				case 3:
+					m.Pop(key)
+				case 4:
+					m.RemoveAndCheckEmpty(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if m.Count() != scanCount(m) {
+		t.Errorf("count %d differs from the %d items in the shards", m.Count(), scanCount(m))
+	}
+}
+
+func TestForEachOrdered(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(fmt.Sprintf("%03d", i), i)
+	}
+
+	keys := m.SortedKeys()
+	if !sort.StringsAreSorted(keys) || len(keys) != 100 {
+		t.Error("SortedKeys should return all keys in order.")
+	}
+
+	expected := 0
+	m.ForEachOrdered(func(key string, v int) {
+		if v != expected {
+			t.Errorf("expected %d, got %d", expected, v)
+		}
+		expected += 2
+		// The callback may write to the map.
+		m.Remove(fmt.Sprintf("%03d", v+1))
+	})
+	if expected != 100 {
+		t.Errorf("removed items should be skipped, stopped at %d", expected)
+	}
+}
+
+func TestLockShard(t *testing.T) {
+	m := New[int](WithShardCount[int](4))
+	m.Set("a", 1)
+	index := m.ShardOf("a")
+
+	_, unlock := m.LockShard(index)
+	done := make(chan struct{})
+	go func() {
+		m.Set("a", 2)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("writes to a locked shard should block.")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	unlock()
+	// unlock must be idempotent.
+	unlock()
+	<-done
+	if v, _ := m.Get("a"); v != 2 {
+		t.Error("blocked write should proceed once the shard is unlocked.")
+	}
+
+	// Read, compute and conditional write under the lock.
+	items, unlock := m.LockShard(index)
+	if items["a"] == 2 {
+		items["a"] = 3
+		delete(items, "a")
+		items["a"] = 4
+	}
+	for key := range items {
+		if m.ShardOf(key) != index {
+			t.Errorf("%q does not belong to the locked shard", key)
+		}
+	}
+	var other string
+	for i := 0; ; i++ {
+		if other = "k" + strconv.Itoa(i); m.ShardOf(other) == index {
+			break
+		}
+	}
+	items[other] = 5
+	unlock()
+	if v, _ := m.Get("a"); v != 4 || !m.Has(other) || m.Count() != 2 {
+		t.Errorf("writes through items should apply, got %v (count %d)", m.Items(), m.Count())
+	}
+
+	m.Freeze()
+	defer func() {
+		if recover() == nil {
+			t.Error("LockShard on a frozen map should panic.")
+		}
+	}()
+	m.LockShard(index)
+}
+
+func TestSetOnce(t *testing.T) {
+	m := New[int]()
+
+	wg := sync.WaitGroup{}
+	for i := 1; i <= 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.SetOnce("a", i)
+			if !m.Has("a") {
+				t.Error("SetOnce should return once the value is stored.")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	first, _ := m.Get("a")
+	m.SetOnce("a", 42)
+	if v, _ := m.Get("a"); v != first {
+		t.Error("later calls to SetOnce should be no-ops.")
+	}
+
+	m.Remove("a")
+	m.SetOnce("a", 42)
+	if m.Has("a") {
+		t.Error("SetOnce should not set a key again after its removal.")
+	}
+
+	// Failed calls do not use up the key.
+	mustPanic := func(fn func()) {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected a panic.")
+			}
+		}()
+		fn()
+	}
+	v := New[int](WithMaxSize[int](1), WithKeyValidator[int](func(key string) error {
+		if key == "" {
+			return errors.New("empty")
+		}
+		return nil
+	}))
+	mustPanic(func() { v.SetOnce("", 1) })
+	v.Set("full", 1)
+	mustPanic(func() { v.SetOnce("b", 1) })
+	v.Remove("full")
+	v.SetOnce("b", 2)
+	if got, _ := v.Get("b"); got != 2 {
+		t.Errorf("SetOnce should store after a failed call, got %d", got)
+	}
+	v.Freeze()
+	mustPanic(func() { v.SetOnce("c", 1) })
+}
+
+func TestRLockShard(t *testing.T) {
+	m := New[int](WithShardCount[int](4))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	total := 0
+	for index := 0; index < 4; index++ {
+		items, unlock := m.RLockShard(index)
+		for key, v := range items {
+			if m.ShardOf(key) != index || strconv.Itoa(v) != key {
+				t.Errorf("unexpected item %s in shard %d", key, index)
+			}
+			total++
+		}
+		unlock()
+		unlock()
+	}
+	if total != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+	// All read locks are released, writes must not block.
+	m.Set("0", 0)
+}
+
+func TestConcurrentCountAllWrites(t *testing.T) {
+	m := New[int](WithShardCount[int](8))
+	upsert := func(exist bool, valueInMap int, newValue int) int {
+		return valueInMap + newValue
+	}
+	removeEven := func(key string, v int, exists bool) bool {
+		return v%2 == 0
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 300; i++ {
+				key := strconv.Itoa(i % 40)
+				switch (w + i) % 10 {
+				case 0:
+					m.Upsert(key, i, upsert)
+				case 1:
+					m.RemoveCb(key, removeEven)
+				case 2:
+					m.MSet(map[string]int{key: i, key + "x": i})
+				case 3:
+					m.BatchUpsert(map[string]int{key: i, key + "y": i}, upsert)
+				case 4:
+					m.PopIf(func(k string, v int) bool { return k == key })
+				case 5:
+					m.Transact([]string{key, key + "z"}, func(txn *Txn[int]) error {
+						txn.Set(key+"z", i)
+						txn.Remove(key)
+						return nil
+					})
+				case 6:
+					m.WithShardWrite(key, func(items map[string]int) {
+						delete(items, key)
+					})
+				case 7:
+					m.SetIfAbsent(key, i)
+				case 8:
+					if i%50 == 0 {
+						m.Clear()
+					} else {
+						m.Set(key, i)
+					}
+				case 9:
+					if i%70 == 0 {
+						for range m.PopAll() {
+						}
+					} else {
+						m.Pop(key)
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if m.Count() != scanCount(m) {
+		t.Errorf("count %d differs from the %d items in the shards", m.Count(), scanCount(m))
+	}
+}
+
+func TestMergeFrom(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 1)
+	m.Set("b", 2)
+
+	stream := "{\"a\": 10, \"c\": 30}\n{\"b\": 20}\n{\"c\": 3}\n"
+	sum := func(key string, existing, incoming int) int {
+		return existing + incoming
+	}
+	if err := m.MergeFrom(strings.NewReader(stream), sum); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int{"a": 11, "b": 22, "c": 33}
+	for key, v := range expected {
+		if got, _ := m.Get(key); got != v {
+			t.Errorf("expected %d under %s, got %d", v, key, got)
+		}
+	}
+
+	if err := m.MergeFrom(strings.NewReader("{\"a\": 0}\n"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := m.Get("a"); a != 0 {
+		t.Error("incoming values should win without a resolver.")
+	}
+
+	if err := m.MergeFrom(strings.NewReader("{\"d\": 4}\n{\"e\": "), nil); err == nil {
+		t.Error("a truncated stream should fail.")
+	}
+	if !m.Has("d") {
+		t.Error("objects decoded before the error should be merged.")
+	}
+}
+
+func TestWithKeyTransformer(t *testing.T) {
+	m := New[int](WithKeyTransformer[int](strings.ToLower), WithInitialData(map[string]int{"Init": 0}))
+
+	m.Set("Foo", 1)
+	if v, ok := m.Get("FOO"); !ok || v != 1 {
+		t.Error("keys should be normalized on Get.")
+	}
+	if !m.Has("foo") || !m.Has("init") {
+		t.Error("keys should be normalized on Has.")
+	}
+	if m.GetShard("FOO") != m.GetShard("foo") || m.ShardOf("Foo") != m.ShardOf("foo") {
+		t.Error("sharding should use the normalized key.")
+	}
+
+	m.MSet(map[string]int{"BAR": 2, "Baz": 3})
+	m.Upsert("bar", 10, func(exist bool, valueInMap int, newValue int) int {
+		return valueInMap + newValue
+	})
+	if v, _ := m.Get("Bar"); v != 12 {
+		t.Error("keys should be normalized on MSet and Upsert.")
+	}
+
+	keys := m.SortedKeys()
+	if strings.Join(keys, ",") != "bar,baz,foo,init" {
+		t.Errorf("keys should be stored normalized, got %v", keys)
+	}
+
+	m.Remove("FOO")
+	if m.Has("foo") || m.Count() != 3 {
+		t.Error("keys should be normalized on Remove.")
+	}
+}
+
+func TestWithSequentialIteration(t *testing.T) {
+	m := New[int](WithSequentialIteration[int](), WithShardCount[int](8))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	if len(m.Keys()) != 100 {
+		t.Error("Keys should return 100 elements.")
+	}
+	if len(m.Items()) != 100 {
+		t.Error("Items should return 100 elements.")
+	}
+	counter := 0
+	for item := range m.IterBuffered() {
+		if strconv.Itoa(item.Val) != item.Key {
+			t.Errorf("unexpected item %v", item)
+		}
+		counter++
+	}
+	if counter != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	counter = 0
+	for range m.PopAll() {
+		counter++
+	}
+	if counter != 100 || !m.IsEmpty() {
+		t.Error("PopAll should return all elements and empty the map.")
+	}
+}
+
+func TestMSetCount(t *testing.T) {
+	m := New[int]()
+	m.MSet(map[string]int{"a": 1, "b": 2, "c": 3})
+
+	inserted := m.MSetCount(map[string]int{"b": 20, "c": 30, "d": 40, "e": 50})
+	if inserted != 2 {
+		t.Errorf("expected 2 inserted keys, got %d", inserted)
+	}
+	if m.Count() != 5 || scanCount(m) != 5 {
+		t.Errorf("expected 5 elements, got %d", m.Count())
+	}
+	if v, _ := m.Get("b"); v != 20 {
+		t.Errorf("expected b to be overwritten, got %d", v)
+	}
+
+	if inserted := m.MSetCount(map[string]int{"a": 10}); inserted != 0 {
+		t.Errorf("expected 0 inserted keys, got %d", inserted)
+	}
+}
+
+func TestWithKeyValidator(t *testing.T) {
+	errSpace := errors.New("key contains a space")
+	noSpaces := WithKeyValidator[int](func(key string) error {
+		if strings.Contains(key, " ") {
+			return errSpace
+		}
+		return nil
+	})
+	m := New[int](noSpaces)
+
+	mustPanic := func(name string, fn func()) {
+		t.Helper()
+		defer func() {
+			r := recover()
+			err, ok := r.(error)
+			if !ok || !errors.Is(err, ErrInvalidKey) || !errors.Is(err, errSpace) {
+				t.Errorf("%s: expected an invalid key panic, got %v", name, r)
+			}
+		}()
+		fn()
+	}
+	if err := m.Set("a b", 1); !errors.Is(err, ErrInvalidKey) || !errors.Is(err, errSpace) {
+		t.Errorf("Set: expected an invalid key error, got %v", err)
+	}
+	_, err := m.Upsert("a b", 1, func(exist bool, valueInMap, newValue int) int { return newValue })
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Upsert: expected an invalid key error, got %v", err)
+	}
+	mustPanic("MustSet", func() { m.MustSet("a b", 1) })
+	mustPanic("SetIfAbsent", func() { m.SetIfAbsent("a b", 1) })
+	mustPanic("MSet", func() { m.MSet(map[string]int{"a": 1, "a b": 2}) })
+	if !m.IsEmpty() {
+		t.Error("rejected writes should not store anything.")
+	}
+
+	m.Set("a", 1)
+	if v, ok := m.Get("a"); !ok || v != 1 {
+		t.Error("valid keys should be stored.")
+	}
+
+	_, err = NewWithError[int](noSpaces, WithInitialData(map[string]int{"a b": 1}))
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("expected ErrInvalidKey, got %v", err)
+	}
+
+	err = m.Transact([]string{"b", "c d"}, func(txn *Txn[int]) error {
+		txn.Set("b", 2)
+		txn.Set("c d", 3)
+		return nil
+	})
+	if !errors.Is(err, errSpace) {
+		t.Errorf("expected the validator error, got %v", err)
+	}
+	if m.Has("b") {
+		t.Error("a transaction with a rejected key should not be applied.")
+	}
+
+	err = NewTyped[int]("sessions", noSpaces).Set("a b", 1)
+	if !errors.Is(err, errSpace) || !strings.Contains(err.Error(), `(map "sessions")`) {
+		t.Errorf("expected the error to name the map, got %v", err)
+	}
+}
+
+func TestGroupByShardParallel(t *testing.T) {
+	m := New[int](WithShardCount[int](8))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	sums := GroupByShardParallel(m, func(shardIndex int, items map[string]int) int {
+		sum := 0
+		for key, val := range items {
+			if m.ShardOf(key) != shardIndex {
+				t.Errorf("key %q passed for shard %d", key, shardIndex)
+			}
+			sum += val
+		}
+		return sum
+	})
+	if len(sums) != 8 {
+		t.Fatalf("expected one result per shard, got %d", len(sums))
+	}
+	total := 0
+	for _, sum := range sums {
+		total += sum
+	}
+	if total != 4950 {
+		t.Errorf("expected a total of 4950, got %d", total)
+	}
+}
+
+func TestWithLockTracer(t *testing.T) {
+	var mu sync.Mutex
+	var ops []string
+	m := New[int](WithLockTracer[int](func(op string, key string, held time.Duration) {
+		if held < 0 {
+			t.Errorf("negative lock duration %v", held)
+		}
+		mu.Lock()
+		ops = append(ops, op+":"+key)
+		mu.Unlock()
+	}))
+
+	m.Set("a", 1)
+	m.Remove("a")
+	m.Get("a")
+
+	if len(ops) != 2 || ops[0] != "Set:a" || ops[1] != "Remove:a" {
+		t.Errorf("unexpected traced operations %v", ops)
+	}
+}
+
+func TestNotifyOnEmpty(t *testing.T) {
+	m := New[int]()
+	select {
+	case <-m.NotifyOnEmpty():
+	default:
+		t.Error("channel should be closed for an empty map.")
+	}
+
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	empty := m.NotifyOnEmpty()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < 100; i += 4 {
+				select {
+				case <-empty:
+					t.Error("channel closed before the map was empty.")
+				default:
+				}
+				m.Remove(strconv.Itoa(i))
+			}
+		}(w)
+	}
+	select {
+	case <-empty:
+	case <-time.After(time.Second):
+		t.Fatal("channel should be closed once the map is empty.")
+	}
+	wg.Wait()
+
+	m.Set("a", 1)
+	empty = m.NotifyOnEmpty()
+	m.Clear()
+	select {
+	case <-empty:
+	case <-time.After(time.Second):
+		t.Fatal("Clear should close the channel.")
+	}
+}
+
+func TestIterCbParallel(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	for _, workers := range []int{0, 1, 4, 1000} {
+		var mu sync.Mutex
+		visits := make(map[string]int)
+		m.IterCbParallel(workers, func(key string, v int) {
+			mu.Lock()
+			visits[key]++
+			mu.Unlock()
+		})
+		if len(visits) != 1000 {
+			t.Errorf("%d workers: expected 1000 visited keys, got %d", workers, len(visits))
+		}
+		for key, n := range visits {
+			if n != 1 {
+				t.Errorf("%d workers: %s visited %d times", workers, key, n)
+			}
+		}
+	}
+}
+
+func TestFreeze(t *testing.T) {
+	m := NewTyped[int]("config")
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	m.Freeze()
+	m.Freeze()
+	if !m.IsFrozen() {
+		t.Error("map should be frozen after Freeze.")
+	}
+
+	var freezeErr *FreezeError
+	if err := m.Set("a", 1); !errors.As(err, &freezeErr) || freezeErr.Name != "config" {
+		t.Errorf("expected a FreezeError, got %v", err)
+	}
+	if err := m.Remove("1"); !errors.As(err, &freezeErr) {
+		t.Errorf("expected a FreezeError, got %v", err)
+	}
+	func() {
+		defer func() {
+			if err, ok := recover().(error); !ok || !errors.As(err, &freezeErr) {
+				t.Errorf("expected a FreezeError panic, got %v", err)
+			}
+		}()
+		m.MSet(map[string]int{"a": 1})
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if v, ok := m.Get(strconv.Itoa(i)); !ok || v != i {
+					t.Errorf("frozen map lost %d", i)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if !m.Has("42") || m.Has("a") || len(m.Keys()) != 100 || m.Count() != 100 {
+		t.Error("frozen map should keep its items.")
+	}
+}
+
+func TestNotifyOnFull(t *testing.T) {
+	m := New[int](WithMaxSize[int](10))
+	if m.Options().MaxSize != 10 {
+		t.Error("MaxSize should be reported in options.")
+	}
+	full := m.NotifyOnFull()
+	for i := 0; i < 9; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	m.Set("0", 0) // updates do not grow the map
+	select {
+	case <-full:
+		t.Fatal("channel closed before the map was full.")
+	default:
+	}
+
+	m.Set("9", 9)
+	select {
+	case <-full:
+	default:
+		t.Fatal("channel should be closed once the map is full.")
+	}
+	m.Remove("9")
+	m.Set("9", 9) // reaching the size again must not close twice
+
+	if New[int]().NotifyOnFull() != nil {
+		t.Error("maps without a max size should return a nil channel.")
+	}
+	if _, err := NewWithError(WithMaxSize[int](0)); err != ErrMaxSizeNotPositive {
+		t.Errorf("expected ErrMaxSizeNotPositive, got %v", err)
+	}
+}
+
+func TestCopyTo(t *testing.T) {
+	a := New[int]()
+	b := New[int](WithShardCount[int](4))
+	for i := 0; i < 50; i++ {
+		a.Set("a"+strconv.Itoa(i), i)
+		b.Set("b"+strconv.Itoa(i), i)
+	}
+	b.Set("shared", 1)
+	a.Set("shared", 2)
+
+	dst := New[int]()
+	dst.Set("existing", 0)
+	if err := a.CopyTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.CopyTo(dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Count() != 102 || scanCount(dst) != 102 {
+		t.Errorf("expected 102 elements, got %d", dst.Count())
+	}
+	for i := 0; i < 50; i++ {
+		if !dst.Has("a"+strconv.Itoa(i)) || !dst.Has("b"+strconv.Itoa(i)) {
+			t.Errorf("missing key %d", i)
+		}
+	}
+	if v, _ := dst.Get("shared"); v != 1 {
+		t.Error("the last copy should win.")
+	}
+
+	dst.Freeze()
+	var freezeErr *FreezeError
+	if err := a.CopyTo(dst); !errors.As(err, &freezeErr) {
+		t.Errorf("expected a FreezeError, got %v", err)
+	}
+}
+
+func TestIterByShardIndex(t *testing.T) {
+	m := New[int](WithShardCount[int](8))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	counter := 0
+	for idx := 0; idx < 8; idx++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			for item := range m.IterByShardIndex(idx) {
+				if m.ShardOf(item.Key) != idx {
+					t.Errorf("%s belongs to another shard", item.Key)
+				}
+				mu.Lock()
+				counter++
+				mu.Unlock()
+			}
+		}(idx)
+	}
+	wg.Wait()
+	if counter != 100 {
+		t.Error("We should have counted 100 elements.")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("an out of range shard index should panic.")
+		}
+	}()
+	m.IterByShardIndex(8)
+}
+
+func TestSnapshot(t *testing.T) {
+	m := New[int](WithShardCount[int](8))
+	// Keep two keys of different shards equal at all times.
+	a, b := "a", "b"
+	for i := 0; m.ShardOf(a) == m.ShardOf(b); i++ {
+		b = "b" + strconv.Itoa(i)
+	}
+	m.Set(a, 0)
+	m.Set(b, 0)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			m.Transact([]string{a, b}, func(txn *Txn[int]) error {
+				txn.Set(a, i)
+				txn.Set(b, i)
+				return nil
+			})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		snap := m.Snapshot()
+		va, _ := snap.Get(a)
+		vb, _ := snap.Get(b)
+		if va != vb {
+			t.Fatalf("inconsistent snapshot: %d != %d", va, vb)
+		}
+		if snap.Count() != 2 {
+			t.Fatalf("expected 2 elements, got %d", snap.Count())
+		}
+	}
+	close(stop)
+	<-done
+
+	snap := m.Snapshot()
+	snap.Set("c", 1)
+	if m.Has("c") {
+		t.Error("snapshot should be independent of the original.")
+	}
+
+	m = New[int](WithKeyTransformer[int](strings.ToLower))
+	m.Set("FOO", 1)
+	if !m.Snapshot().Has("FOO") {
+		t.Error("snapshot should normalize keys like the original.")
+	}
+}
+
+func TestGetBatch(t *testing.T) {
+	m := New[int](WithMetrics[int]())
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	keys := []string{"42", "missing", "7", "99", "", "42"}
+	values, found := m.GetBatch(keys)
+	if len(values) != len(keys) || len(found) != len(keys) {
+		t.Fatal("results should be aligned with keys.")
+	}
+	expected := []int{42, 0, 7, 99, 0, 42}
+	expectedFound := []bool{true, false, true, true, false, true}
+	for i := range keys {
+		if values[i] != expected[i] || found[i] != expectedFound[i] {
+			t.Errorf("keys[%d]=%q: got (%d, %v)", i, keys[i], values[i], found[i])
+		}
+	}
+	if metrics := m.Metrics(); metrics.Hits != 4 || metrics.Misses != 2 {
+		t.Errorf("unexpected metrics %+v", metrics)
+	}
+
+	values, found = m.GetBatch(nil)
+	if len(values) != 0 || len(found) != 0 {
+		t.Error("no keys should give empty results.")
+	}
+}
+
+func TestWithSyncAfterWrite(t *testing.T) {
+	m := New[int](WithSyncAfterWrite[int]())
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(w*100 + i)
+				m.Set(key, i)
+				m.Get(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+	if m.Count() != 400 {
+		t.Errorf("expected 400 elements, got %d", m.Count())
+	}
+	m.Remove("0")
+	if _, ok := m.Pop("1"); !ok || m.Count() != 398 {
+		t.Error("writes should behave as without the option.")
+	}
+}
+
+func TestSetBulkFromChannel(t *testing.T) {
+	m := New[int]()
+	m.Set("0", -1)
+
+	ch := make(chan Tuple[int], 16)
+	go func() {
+		for i := 0; i < 5000; i++ {
+			ch <- Tuple[int]{strconv.Itoa(i), i}
+			if i%1000 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+		ch <- Tuple[int]{"1", 100}
+		close(ch)
+	}()
+
+	if n := m.SetBulkFromChannel(ch); n != 5001 {
+		t.Errorf("expected 5001 tuples set, got %d", n)
+	}
+	if m.Count() != 5000 || scanCount(m) != 5000 {
+		t.Errorf("expected 5000 elements, got %d", m.Count())
+	}
+	if v, _ := m.Get("0"); v != 0 {
+		t.Error("existing keys should be overwritten.")
+	}
+	if v, _ := m.Get("1"); v != 100 {
+		t.Error("later tuples should win.")
+	}
+
+	empty := make(chan Tuple[int])
+	close(empty)
+	if n := m.SetBulkFromChannel(empty); n != 0 {
+		t.Errorf("expected 0 tuples set, got %d", n)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := New[int]()
+	old.MSet(map[string]int{"a": 1, "b": 2, "c": 3})
+	current := New[int](WithShardCount[int](4))
+	current.MSet(map[string]int{"b": 2, "c": 30, "d": 4})
+
+	added, removed, changed := old.Diff(current, func(a, b int) bool { return a == b })
+	if len(added) != 1 || added[0] != (Tuple[int]{"d", 4}) {
+		t.Errorf("unexpected added items %v", added)
+	}
+	if len(removed) != 1 || removed[0] != (Tuple[int]{"a", 1}) {
+		t.Errorf("unexpected removed items %v", removed)
+	}
+	if len(changed) != 1 || changed[0] != (Tuple[int]{"c", 30}) {
+		t.Errorf("unexpected changed items %v", changed)
+	}
+
+	added, removed, changed = old.Diff(old.Clone(), func(a, b int) bool { return a == b })
+	if len(added)+len(removed)+len(changed) != 0 {
+		t.Error("equal maps should have no differences.")
+	}
+}
+
+func TestMarshalJSONFiltered(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("secret", 42)
+
+	j, err := m.MarshalJSONFiltered(func(key string, v int) bool {
+		return key != "secret"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `{"a":1,"b":2}` {
+		t.Errorf("unexpected output: %s", j)
+	}
+	if strings.Contains(string(j), "secret") {
+		t.Error("excluded entries should not be marshaled.")
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%q:%d", strconv.Itoa(i), i)
+	}
+	b.WriteString("}")
+
+	m := New[int]()
+	if err := m.ReadJSON(strings.NewReader(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	if m.Count() != 10000 {
+		t.Errorf("expected 10000 elements, got %d", m.Count())
+	}
+	if v, _ := m.Get("9999"); v != 9999 {
+		t.Error("missing element 9999.")
+	}
+
+	for _, input := range []string{``, `[1, 2]`, `{"a": 1, "b": "two"}`, `{"a": 1`, `{"a" 1}`} {
+		err := New[int]().ReadJSON(strings.NewReader(input))
+		if err == nil || !strings.HasPrefix(err.Error(), "cmap: read JSON:") {
+			t.Errorf("%q: expected a descriptive error, got %v", input, err)
+		}
+	}
+}
+
+func TestPipelineTo(t *testing.T) {
+	a := New[int]()
+	b := New[int]()
+	for i := 0; i < 100; i++ {
+		a.Set("a"+strconv.Itoa(i), i)
+		b.Set("b"+strconv.Itoa(i), i)
+	}
+
+	out := make(chan Tuple[int])
+	go func() {
+		a.PipelineTo(out)
+		b.PipelineTo(out)
+		close(out)
+	}()
+	seen := make(map[string]int)
+	for item := range out {
+		seen[item.Key] = item.Val
+	}
+	if len(seen) != 200 {
+		t.Errorf("expected 200 items, got %d", len(seen))
+	}
+}
+
+func TestSplitByKey(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	split := m.SplitByKey(func(key string) bool {
+		return strings.HasPrefix(key, "1")
+	})
+	// 1, 10-19.
+	if split.Count() != 11 || scanCount(split) != 11 {
+		t.Errorf("expected 11 split elements, got %d", split.Count())
+	}
+	if m.Count() != 89 || scanCount(m) != 89 {
+		t.Errorf("expected 89 remaining elements, got %d", m.Count())
+	}
+	for _, key := range split.Keys() {
+		if m.Has(key) {
+			t.Errorf("%s should have been removed from m", key)
+		}
+		if v, _ := split.Get(key); strconv.Itoa(v) != key {
+			t.Errorf("unexpected value for %s", key)
+		}
+	}
+	if m.Has("1") || !split.Has("1") {
+		t.Error("1 should have moved to the split map.")
+	}
+
+	lower := New[int](WithKeyTransformer[int](strings.ToLower))
+	lower.Set("FOO", 1)
+	if !lower.SplitByKey(func(string) bool { return true }).Has("FOO") {
+		t.Error("the split map should normalize keys like the original.")
+	}
+}
+
+func TestGetOrCompute(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 1)
+
+	if v, loaded := m.GetOrSet("a", 2); !loaded || v != 1 {
+		t.Errorf("expected the existing value, got (%d, %v)", v, loaded)
+	}
+	if v, loaded := m.GetOrSet("b", 2); loaded || v != 2 {
+		t.Errorf("expected the set value, got (%d, %v)", v, loaded)
+	}
+
+	var calls sync.Map
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(i)
+				v, _ := m.GetOrCompute(key, func() int {
+					if _, dup := calls.LoadOrStore(key, true); dup {
+						t.Errorf("fn called twice for %s", key)
+					}
+					return i * 10
+				})
+				if v != i*10 {
+					t.Errorf("expected %d, got %d", i*10, v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if m.Count() != 102 || scanCount(m) != 102 {
+		t.Errorf("expected 102 elements, got %d", m.Count())
+	}
+}
+
+func TestReadJSONStream(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&b, "{%q: %d, %q: %d}\n", strconv.Itoa(2*i), 2*i, strconv.Itoa(2*i+1), 2*i+1)
+	}
+	b.WriteString(`{"0": -1}{"last": 1}`)
+
+	m := New[int]()
+	if err := m.ReadJSONStream(strings.NewReader(b.String())); err != nil {
+		t.Fatal(err)
+	}
+	if m.Count() != 201 {
+		t.Errorf("expected 201 elements, got %d", m.Count())
+	}
+	if v, _ := m.Get("0"); v != -1 {
+		t.Error("later objects should overwrite earlier ones.")
+	}
+
+	if err := New[int]().ReadJSONStream(strings.NewReader("")); err != nil {
+		t.Errorf("an empty stream should not fail, got %v", err)
+	}
+	err := New[int]().ReadJSONStream(strings.NewReader(`{"a": 1} {"b": "two"}`))
+	if err == nil || !strings.Contains(err.Error(), `"b"`) {
+		t.Errorf("expected an error naming the key, got %v", err)
+	}
+}
+
+func TestWithModuloSharding(t *testing.T) {
+	m := New[int](WithModuloSharding[int](), WithShardCount[int](8))
+	for _, tc := range []struct {
+		key   string
+		shard int
+	}{
+		{"", 0},
+		{"\x00", 0},
+		{"\x03anything", 3},
+		{"\x08", 0},
+		{"\x0b", 3},
+		{"a", 'a' % 8},
+	} {
+		if shard := m.ShardOf(tc.key); shard != tc.shard {
+			t.Errorf("%q: expected shard %d, got %d", tc.key, tc.shard, shard)
+		}
+	}
+
+	m.Set("\x05a", 1)
+	m.Set("\x05b", 2)
+	if m.GetShard("\x05a") != m.GetShard("\x05b") || len(m.SelectByShard(5)) != 2 {
+		t.Error("keys with the same first byte should share a shard.")
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var order []string
+	load := func(m *ConcurrentMap[int]) {
+		order = append(order, "load")
+		m.MSet(map[string]int{"a": 1, "b": 2})
+	}
+	applyDefaults := func(m *ConcurrentMap[int]) {
+		order = append(order, "defaults")
+		m.SetIfAbsent("a", 0)
+		m.SetIfAbsent("c", 0)
+	}
+
+	m := New[int]()
+	if m.Pipeline(load, applyDefaults) != m {
+		t.Error("Pipeline should return the receiver.")
+	}
+	if strings.Join(order, ",") != "load,defaults" {
+		t.Errorf("steps should run in order, got %v", order)
+	}
+	if v, _ := m.Get("a"); v != 1 || m.Count() != 3 {
+		t.Error("every step should apply to the map.")
+	}
+	if m.Pipeline() != m {
+		t.Error("an empty pipeline should return the receiver.")
+	}
+}
+
+func TestWithCapacityPerShard(t *testing.T) {
+	m := New[int](WithCapacityPerShard[int](64), WithShardCount[int](4))
+	for i := 0; i < 200; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	if m.Count() != 200 {
+		t.Errorf("expected 200 elements, got %d", m.Count())
+	}
+	for range m.PopAll() {
+	}
+	m.Set("a", 1)
+	if m.Count() != 1 {
+		t.Error("shards should be usable after PopAll.")
+	}
+
+	if _, err := NewWithError(WithCapacityPerShard[int](-1)); err != ErrCapacityNegative {
+		t.Errorf("expected ErrCapacityNegative, got %v", err)
+	}
+}
+
+func TestVals(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+
+	sum := 0
+	for v := range m.Vals() {
+		sum += v
+	}
+	if sum != 4950 {
+		t.Errorf("expected a sum of 4950, got %d", sum)
+	}
+
+	counter := 0
+	for range m.Vals() {
+		counter++
+		if counter == 10 {
+			break
+		}
+	}
+	if counter != 10 {
+		t.Errorf("expected to stop after 10 values, got %d", counter)
+	}
+	// The read locks must have been released by the break.
+	m.Set("after", 1)
+
+	keys := 0
+	for key, v := range m.All() {
+		if key != "after" && strconv.Itoa(v) != key {
+			t.Errorf("unexpected item %s=%d", key, v)
+		}
+		keys++
+	}
+	if keys != 101 {
+		t.Errorf("expected 101 items, got %d", keys)
+	}
+}
+
+func TestMarshalJSONPretty(t *testing.T) {
+	m := New[int]()
+	m.Set("b", 2)
+	m.Set("a", 1)
+	m.Set("c", 3)
+
+	j, err := m.MarshalJSONPretty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "{\n  \"a\": 1,\n  \"b\": 2,\n  \"c\": 3\n}"
+	if string(j) != expected {
+		t.Errorf("unexpected output:\n%s", j)
+	}
+}
+
+func TestWithOnEvict(t *testing.T) {
+	var m *ConcurrentMap[int]
+	var evicted []string
+	m = New[int](WithShardCount[int](1), WithMaxSize[int](2), WithOnEvict(func(key string, v int) {
+		items := m.shards[0].items
+		if _, ok := items[key]; ok {
+			t.Errorf("evicted key %q still in the shard", key)
+		}
+		if _, ok := items["c"]; ok {
+			t.Error("new key visible before the eviction callback")
+		}
+		evicted = append(evicted, key)
+	}))
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("a", 3)
+	if len(evicted) != 0 {
+		t.Errorf("overwrites should not evict, got %v", evicted)
+	}
+	m.Set("c", 4)
+	if len(evicted) != 1 {
+		t.Fatalf("expected one eviction, got %v", evicted)
+	}
+	if m.Has(evicted[0]) || !m.Has("c") || m.Count() != 2 {
+		t.Errorf("unexpected content after eviction: %v", m.Items())
+	}
+}
+
+func TestPrettyString(t *testing.T) {
+	m := New[int]()
+	m.Set("b", 2)
+	m.Set("a", 1)
+	if s := m.PrettyString(); s != "{\n  \"a\": 1,\n  \"b\": 2\n}" {
+		t.Errorf("unexpected output:\n%s", s)
+	}
+
+	f := New[func()]()
+	f.Set("a", func() {})
+	if s := f.PrettyString(); !strings.HasPrefix(s, "cmap: json: unsupported type") {
+		t.Errorf("expected the marshalling error, got %q", s)
+	}
+}
+
+func TestRename(t *testing.T) {
+	// Same shard.
+	m := New[int](WithShardCount[int](1))
+	m.Set("tmp", 1)
+	if !m.Rename("tmp", "final") {
+		t.Error("Rename should report the existing key.")
+	}
+	if m.Has("tmp") || m.Count() != 1 {
+		t.Error("old key should be gone.")
+	}
+	if v, _ := m.Get("final"); v != 1 {
+		t.Errorf("expected 1, got %d", v)
+	}
+	if m.Rename("missing", "final") {
+		t.Error("Rename of a missing key should fail.")
+	}
+	if v, _ := m.Get("final"); v != 1 {
+		t.Error("a failed Rename should not touch newKey.")
+	}
+
+	// Cross shard, overwriting newKey.
+	m = New[int]()
+	oldKey, newKey := "a", "b"
+	for i := 0; m.shardIndex(oldKey) == m.shardIndex(newKey); i++ {
+		newKey = "b" + strconv.Itoa(i)
+	}
+	m.Set(oldKey, 1)
+	m.Set(newKey, 2)
+	if !m.Rename(oldKey, newKey) {
+		t.Error("Rename should report the existing key.")
+	}
+	if m.Has(oldKey) || m.Count() != 1 {
+		t.Errorf("expected only %q, got %v", newKey, m.Items())
+	}
+	if v, _ := m.Get(newKey); v != 1 {
+		t.Errorf("expected newKey to be overwritten with 1, got %d", v)
+	}
+
+	// Opposite directions concurrently must not deadlock.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if i == 0 {
+					m.Rename(oldKey, newKey)
+				} else {
+					m.Rename(newKey, oldKey)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if m.Count() != 1 {
+		t.Errorf("expected one key, got %v", m.Items())
+	}
+}
+
+func TestGetShardStats(t *testing.T) {
+	m := New[int](WithShardCount[int](4))
+	m.Set("a", 1)
+	m.Get("a")
+	stats := m.GetShardStats()
+	if len(stats) != 4 {
+		t.Fatalf("expected 4 shards, got %d", len(stats))
+	}
+	for i, s := range stats {
+		if s != (ShardStats{}) {
+			t.Errorf("shard %d: expected zero stats without WithDebug, got %+v", i, s)
+		}
+	}
+
+	m = New[int](WithShardCount[int](4), WithDebug[int]())
+	m.Set("a", 1)
+	m.Get("a")
+	m.Get("a")
+	s := m.GetShardStats()[m.ShardOf("a")]
+	if s.WriteOps != 1 || s.ReadOps != 2 {
+		t.Errorf("expected 1 write and 2 reads, got %+v", s)
+	}
+
+	_, unlock := m.LockShard(m.ShardOf("a"))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		unlock()
+	}()
+	m.Get("a")
+	s = m.GetShardStats()[m.ShardOf("a")]
+	if s.ReadLockWaitNs < uint64(5*time.Millisecond) {
+		t.Errorf("expected the blocked read to be accounted, got %+v", s)
+	}
+}
+
+func TestGoString(t *testing.T) {
+	m := New[int](WithShardCount[int](8))
+	m.Set("b", 2)
+	m.Set("a", 1)
+	expected := "cmap.New[int](cmap.WithShardCount[int](8))\nSet(\"a\", 1)\nSet(\"b\", 2)"
+	if s := fmt.Sprintf("%#v", m); s != expected {
+		t.Errorf("unexpected output:\n%s", s)
+	}
+
+	a := New[Animal]()
+	a.Set("x", Animal{"x"})
+	expected = "cmap.New[cmap.Animal](cmap.WithShardCount[cmap.Animal](128))\nSet(\"x\", cmap.Animal{name:\"x\"})"
+	if s := a.GoString(); s != expected {
+		t.Errorf("unexpected output:\n%s", s)
+	}
+}
+
+func TestTryGet(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 1)
+	if v, ok, err := m.TryGet("a", time.Millisecond); err != nil || !ok || v != 1 {
+		t.Errorf("expected 1, got %d, %v, %v", v, ok, err)
+	}
+
+	_, unlock := m.LockShard(m.ShardOf("a"))
+	start := time.Now()
+	_, _, err := m.TryGet("a", 20*time.Millisecond)
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("expected ErrLockTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("TryGet gave up after %v only", elapsed)
+	}
+
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		unlock()
+	}()
+	if v, ok, err := m.TryGet("a", time.Second); err != nil || !ok || v != 1 {
+		t.Errorf("expected 1 once unlocked, got %d, %v, %v", v, ok, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a := New[int]()
+	a.Set("x", 1)
+	a.Set("y", 2)
+	b := New[int]()
+	b.Set("y", 20)
+	b.Set("z", 30)
+
+	m := Merge(a, nil, b)
+	if m.Count() != 3 {
+		t.Errorf("expected 3 elements, got %v", m.Items())
+	}
+	if v, _ := m.Get("y"); v != 20 {
+		t.Errorf("expected the last map to win, got %d", v)
+	}
+	if Merge[int]().Count() != 0 {
+		t.Error("merging nothing should give an empty map.")
+	}
+
+	sum := MergeWith(func(key string, a, b int) int { return a + b }, a, b, b)
+	if v, _ := sum.Get("y"); v != 42 {
+		t.Errorf("expected 2+20+20, got %d", v)
+	}
+	if v, _ := sum.Get("x"); v != 1 {
+		t.Errorf("expected 1, got %d", v)
+	}
+}
+
+func TestLockContention(t *testing.T) {
+	m := New[int](WithShardCount[int](1), WithDebug[int]())
+	if c := m.LockContention(); c != 0 {
+		t.Errorf("expected 0 before any access, got %v", c)
+	}
+	m.Set("a", 1)
+	m.Get("a")
+	if c := m.LockContention(); c != 0 {
+		t.Errorf("expected 0 without concurrent access, got %v", c)
+	}
+
+	_, unlock := m.LockShard(0)
+	done := make(chan struct{})
+	go func() {
+		m.Get("a")
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	unlock()
+	<-done
+	// Set, Get, LockShard and the waiting Get.
+	if c := m.LockContention(); c != 0.25 {
+		t.Errorf("expected 1 contended acquisition out of 4, got %v", c)
+	}
+	if s := m.GetShardStats()[0]; s.ReadContended != 1 || s.WriteContended != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	if New[int]().LockContention() != 0 {
+		t.Error("expected 0 without WithDebug.")
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	a := New[int]()
+	a.Set("x", 1)
+	a.Set("y", 2)
+	a.Set("z", 3)
+	b := New[int]()
+	b.Set("y", 2)
+	b.Set("z", 30)
+
+	var calls [][2]int
+	eq := func(x, y int) bool {
+		calls = append(calls, [2]int{x, y})
+		return x == y
+	}
+	m := Intersect(a, b, eq)
+	if m.Count() != 1 || !m.Has("y") {
+		t.Errorf("expected only y, got %v", m.Items())
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i][0] < calls[j][0] })
+	if len(calls) != 2 || calls[0] != [2]int{2, 2} || calls[1] != [2]int{3, 30} {
+		t.Errorf("expected eq to be called with (a, b) for y and z, got %v", calls)
+	}
+
+	// The result holds the values of a, whichever map is smaller.
+	m = Intersect(b, a, func(x, y int) bool { return x/10 == y/10 })
+	if v, _ := m.Get("y"); v != 2 || m.Count() != 1 {
+		t.Errorf("unexpected intersection %v", m.Items())
+	}
+	m = Intersect(b, a, func(x, y int) bool { return true })
+	if v, _ := m.Get("z"); v != 30 {
+		t.Errorf("expected the value of the first map, got %d", v)
+	}
+	if Intersect(a, a, eq).Count() != 3 {
+		t.Error("a map intersected with itself should be unchanged.")
+	}
+}
+
+func TestSampleShards(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 1000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	for _, n := range []int{0, 1, 10, 1000, 2000} {
+		sample := m.SampleShards(n)
+		expected := n
+		if expected > m.Count() {
+			expected = m.Count()
+		}
+		if len(sample) != expected {
+			t.Errorf("SampleShards(%d): expected %d items, got %d", n, expected, len(sample))
+		}
+		seen := make(map[string]bool)
+		for _, item := range sample {
+			if v, ok := m.Get(item.Key); !ok || v != item.Val {
+				t.Errorf("SampleShards(%d): invalid entry %v", n, item)
+			}
+			if seen[item.Key] {
+				t.Errorf("SampleShards(%d): duplicate key %q", n, item.Key)
+			}
+			seen[item.Key] = true
+		}
+	}
+
+	seeded := func() []Tuple[int] {
+		m := New[int](WithRandSource[int](rand.New(rand.NewSource(42))), WithShardCount[int](4))
+		for i := 0; i < 100; i++ {
+			m.Set(strconv.Itoa(i), i)
+		}
+		return m.SampleShards(5)
+	}
+	if a, b := seeded(), seeded(); !reflect.DeepEqual(a, b) {
+		t.Errorf("expected the same sample for the same seed, got %v and %v", a, b)
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	m := New[int]()
+	var reports []int
+	err := m.WarmUp(context.Background(), func(ctx context.Context, emit func(string, int)) error {
+		for i := 0; i < 2500; i++ {
+			emit(strconv.Itoa(i), i)
+		}
+		return nil
+	}, func(loaded int) {
+		reports = append(reports, loaded)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Count() != 2500 {
+		t.Errorf("expected 2500 elements, got %d", m.Count())
+	}
+	if !reflect.DeepEqual(reports, []int{1000, 2000}) {
+		t.Errorf("unexpected progress reports %v", reports)
+	}
+
+	// Cancellation.
+	m = New[int]()
+	ctx, cancel := context.WithCancel(context.Background())
+	err = m.WarmUp(ctx, func(ctx context.Context, emit func(string, int)) error {
+		emit("a", 1)
+		cancel()
+		emit("b", 2)
+		return nil
+	}, nil)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if !m.Has("a") || m.Has("b") {
+		t.Errorf("expected only the records emitted before cancel, got %v", m.Items())
+	}
+
+	// Source and write errors.
+	boom := errors.New("boom")
+	err = New[int]().WarmUp(context.Background(), func(ctx context.Context, emit func(string, int)) error {
+		return boom
+	}, nil)
+	if err != boom {
+		t.Errorf("expected the source error, got %v", err)
+	}
+	m = New[int](WithKeyValidator[int](func(key string) error {
+		if key == "" {
+			return errors.New("empty")
+		}
+		return nil
+	}))
+	err = m.WarmUp(context.Background(), func(ctx context.Context, emit func(string, int)) error {
+		emit("", 1)
+		emit("a", 1)
+		return nil
+	}, nil)
+	if !errors.Is(err, ErrInvalidKey) || !m.Has("a") {
+		t.Errorf("expected ErrInvalidKey and the valid record loaded, got %v", err)
+	}
+}
+
+func TestSubtract(t *testing.T) {
+	fill := func(keys ...string) *ConcurrentMap[int] {
+		m := New[int]()
+		for i, key := range keys {
+			m.Set(key, i)
+		}
+		return m
+	}
+	tests := []struct {
+		name     string
+		a, b     *ConcurrentMap[int]
+		expected []string
+	}{
+		{"empty a", fill(), fill("x"), nil},
+		{"empty b", fill("x", "y"), fill(), []string{"x", "y"}},
+		{"identical", fill("x", "y"), fill("x", "y"), nil},
+		{"disjoint", fill("x", "y"), fill("z"), []string{"x", "y"}},
+		{"overlap", fill("x", "y"), fill("z", "y"), []string{"x"}},
+	}
+	for _, tt := range tests {
+		keys := Subtract(tt.a, tt.b).Keys()
+		sort.Strings(keys)
+		if len(keys) != len(tt.expected) || (len(keys) > 0 && !reflect.DeepEqual(keys, tt.expected)) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, keys)
+		}
+	}
+
+	a := fill("x")
+	if Subtract(a, a).Count() != 0 {
+		t.Error("a map minus itself should be empty.")
+	}
+	// Values of a are kept, whatever b holds.
+	b := New[int]()
+	b.Set("y", 7)
+	if v, _ := Subtract(fill("y", "x"), b).Get("x"); v != 1 {
+		t.Errorf("expected the value of a, got %d", v)
+	}
+}
+
+func TestSubtractConcurrent(t *testing.T) {
+	// With a writer queued on each map, holding a shard of one map while
+	// probing the other deadlocks the two subtractions.
+	a := New[int](WithShardCount[int](1))
+	b := New[int](WithShardCount[int](1))
+	for i := 0; i < 100; i++ {
+		a.Set(strconv.Itoa(i), i)
+		b.Set(strconv.Itoa(i*2), i)
+	}
+	stop := make(chan struct{})
+	for _, m := range []*ConcurrentMap[int]{a, b} {
+		go func(m *ConcurrentMap[int]) {
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+					m.Set(strconv.Itoa(i%100), i)
+				}
+			}
+		}(m)
+	}
+	defer close(stop)
+
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*ConcurrentMap[int]{{a, b}, {b, a}} {
+		wg.Add(1)
+		go func(x, y *ConcurrentMap[int]) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				Subtract(x, y)
+			}
+		}(pair[0], pair[1])
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("concurrent Subtract calls deadlocked.")
+	}
+}
+
+func TestShrink(t *testing.T) {
+	heap := func() uint64 {
+		runtime.GC()
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+	m := New[int]()
+	for i := 0; i < 100000; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	for i := 10; i < 100000; i++ {
+		m.Remove(strconv.Itoa(i))
+	}
+	before := heap()
+	m.Shrink()
+	after := heap()
+	if after >= before || before-after < 1<<20 {
+		t.Errorf("expected Shrink to release the buckets, heap went from %d to %d bytes", before, after)
+	}
+	if m.Count() != 10 {
+		t.Errorf("expected 10 elements, got %d", m.Count())
+	}
+	for i := 0; i < 10; i++ {
+		if v, ok := m.Get(strconv.Itoa(i)); !ok || v != i {
+			t.Errorf("lost %d after Shrink", i)
+		}
+	}
+	runtime.KeepAlive(m)
+}
+
+func TestPartition(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	parts := m.Partition(3, func(key string, v int) int { return v })
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 partitions, got %d", len(parts))
+	}
+	total := 0
+	for g, part := range parts {
+		total += part.Count()
+		part.IterCb(func(key string, v int) {
+			if v%3 != g {
+				t.Errorf("%q landed in partition %d", key, g)
+			}
+			if strconv.Itoa(v) != key {
+				t.Errorf("unexpected entry %q: %d", key, v)
+			}
+		})
+	}
+	if total != 100 || m.Count() != 100 {
+		t.Errorf("expected 100 items in the partitions and the source, got %d and %d", total, m.Count())
+	}
+	if !parts[0].Has("99") || parts[1].Has("99") {
+		t.Error("partitions should be usable like other maps.")
+	}
+
+	neg := m.Partition(4, func(key string, v int) int { return -1 })
+	if neg[3].Count() != 100 {
+		t.Errorf("expected negative groups to count from the end, got %d", neg[3].Count())
+	}
+
+	lower := New[int](WithKeyTransformer[int](strings.ToLower))
+	lower.Set("FOO", 1)
+	if !lower.Partition(1, func(string, int) int { return 0 })[0].Has("FOO") || !lower.Chunk(1)[0].Has("FOO") {
+		t.Error("partitions should normalize keys like the original.")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a non positive count.")
+		}
+	}()
+	m.Partition(0, func(key string, v int) int { return 0 })
+}
+
+func TestIterRangeByHash(t *testing.T) {
+	byValue := func(key string) uint64 {
+		v, _ := strconv.Atoi(key)
+		return uint64(v)
+	}
+	collect := func(minHash, maxHash uint64) ([]int, []int) {
+		m := New[int](WithShardingFunction[int](byValue), WithShardCount[int](10), WithDebug[int]())
+		for i := 0; i < 100; i++ {
+			m.Set(strconv.Itoa(i), i)
+		}
+		var found []int
+		m.IterRangeByHash(minHash, maxHash, func(key string, v int) {
+			found = append(found, v)
+		})
+		sort.Ints(found)
+		var visited []int
+		for i, s := range m.GetShardStats() {
+			if s.ReadOps > 0 {
+				visited = append(visited, i)
+			}
+		}
+		return found, visited
+	}
+
+	found, visited := collect(13, 15)
+	if !reflect.DeepEqual(found, []int{13, 14, 15}) || !reflect.DeepEqual(visited, []int{3, 4, 5}) {
+		t.Errorf("[13, 15]: got %v from shards %v", found, visited)
+	}
+	found, visited = collect(18, 21)
+	if !reflect.DeepEqual(found, []int{18, 19, 20, 21}) || !reflect.DeepEqual(visited, []int{0, 1, 8, 9}) {
+		t.Errorf("[18, 21]: got %v from shards %v", found, visited)
+	}
+	found, visited = collect(0, 1000)
+	if len(found) != 100 || len(visited) != 10 {
+		t.Errorf("[0, 1000]: got %d items from %d shards", len(found), len(visited))
+	}
+	if found, _ = collect(5, 4); len(found) != 0 {
+		t.Errorf("empty range: got %v", found)
+	}
+
+	// Hashes above 32 bits pick the same shards as writes on every platform.
+	const high = 1 << 32
+	m := New[int](WithShardingFunction[int](func(key string) uint64 { return high + byValue(key) }), WithShardCount[int](10))
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	found = nil
+	m.IterRangeByHash(high+13, high+15, func(key string, v int) {
+		found = append(found, v)
+	})
+	sort.Ints(found)
+	if !reflect.DeepEqual(found, []int{13, 14, 15}) {
+		t.Errorf("[2^32+13, 2^32+15]: got %v", found)
+	}
+}
+
+func TestUnion(t *testing.T) {
+	a := New[int]()
+	a.Set("x", 1)
+	a.Set("y", 2)
+	b := New[int]()
+	b.Set("y", 20)
+	b.Set("z", 30)
+
+	m := Union(a, b, nil)
+	expected := map[string]int{"x": 1, "y": 20, "z": 30}
+	if !reflect.DeepEqual(m.Items(), expected) {
+		t.Errorf("expected %v, got %v", expected, m.Items())
+	}
+
+	m = Union(a, b, func(key string, va, vb int) int { return va - vb })
+	if v, _ := m.Get("y"); v != -18 {
+		t.Errorf("expected resolve(y, 2, 20), got %d", v)
+	}
+	if m.Count() != 3 {
+		t.Errorf("expected 3 elements, got %d", m.Count())
+	}
+	if Union(New[int](), New[int](), nil).Count() != 0 {
+		t.Error("the union of empty maps should be empty.")
+	}
+}
+
+func TestChunk(t *testing.T) {
+	m := New[int]()
+	for i := 0; i < 100; i++ {
+		m.Set(strconv.Itoa(i), i)
+	}
+	chunks := m.Chunk(7)
+	if len(chunks) != 7 {
+		t.Fatalf("expected 7 chunks, got %d", len(chunks))
+	}
+	seen := make(map[string]bool)
+	for _, chunk := range chunks {
+		if c := chunk.Count(); c != 14 && c != 15 {
+			t.Errorf("expected 14 or 15 items per chunk, got %d", c)
+		}
+		for key := range chunk.Items() {
+			if seen[key] {
+				t.Errorf("%q is in several chunks", key)
+			}
+			seen[key] = true
+		}
+	}
+	if len(seen) != 100 {
+		t.Errorf("expected 100 items across chunks, got %d", len(seen))
+	}
+
+	chunks[0].Clear()
+	if m.Count() != 100 {
+		t.Error("chunks should not share shards with the source.")
+	}
+	if c := New[int]().Chunk(3); len(c) != 3 || c[2].Count() != 0 {
+		t.Error("an empty map should give empty chunks.")
+	}
+}
+
+func TestBatchUpsertKeys(t *testing.T) {
+	m := New[int](WithShardCount[int](4), WithDebug[int]())
+	m.Set("a", 10)
+	keys := []string{"a", "b", "c", "d", "e", "f", "b"}
+	before := 0
+	for _, s := range m.GetShardStats() {
+		before += int(s.WriteOps)
+	}
+	stored := m.BatchUpsertKeys(keys, 1, func(exist bool, valueInMap int, newValue int) int {
+		return valueInMap + newValue
+	})
+	expected := map[string]int{"a": 11, "b": 2, "c": 1, "d": 1, "e": 1, "f": 1}
+	if !reflect.DeepEqual(stored, expected) {
+		t.Errorf("expected %v, got %v", expected, stored)
+	}
+	if !reflect.DeepEqual(m.Items(), expected) || m.Count() != 6 {
+		t.Errorf("map content %v does not match the returned values", m.Items())
+	}
+	after := 0
+	for _, s := range m.GetShardStats() {
+		after += int(s.WriteOps)
+	}
+	if after-before > 4 {
+		t.Errorf("expected at most one write lock per shard, got %d", after-before)
+	}
+}
+
+func TestWithMaxSizeRejectsOverflow(t *testing.T) {
+	m := NewTyped[int]("sessions", WithMaxSize[int](2))
+	if err := m.Set("a", 1); err != nil {
+		t.Fatal(err)
+	}
+	m.Set("b", 2)
+	err := m.Set("c", 3)
+	if !errors.Is(err, ErrMapFull) || !strings.Contains(err.Error(), `"sessions"`) {
+		t.Errorf("expected ErrMapFull naming the map, got %v", err)
+	}
+	if m.Has("c") || m.Count() != 2 {
+		t.Error("a rejected Set should not insert.")
+	}
+	if err := m.Set("a", 10); err != nil {
+		t.Errorf("updates should succeed on a full map, got %v", err)
+	}
+
+	called := false
+	_, err = m.Upsert("c", 3, func(exist bool, valueInMap int, newValue int) int {
+		called = true
+		return newValue
+	})
+	if !errors.Is(err, ErrMapFull) || called {
+		t.Errorf("expected ErrMapFull without calling cb, got %v", err)
+	}
+	if v, err := m.Upsert("b", 1, func(exist bool, valueInMap int, newValue int) int {
+		return valueInMap + newValue
+	}); err != nil || v != 3 {
+		t.Errorf("expected the update to succeed with 3, got %d, %v", v, err)
+	}
+
+	m.Remove("a")
+	if err := m.Set("c", 3); err != nil {
+		t.Errorf("expected room after a removal, got %v", err)
+	}
+
+	evicting := New[int](WithShardCount[int](1), WithMaxSize[int](1), WithOnEvict(func(string, int) {}))
+	evicting.Set("a", 1)
+	if err := evicting.Set("b", 2); err != nil || evicting.Count() != 1 {
+		t.Errorf("WithOnEvict should evict rather than reject, got %v", err)
+	}
+}
+
+func TestFreezeWhileWaitingForLock(t *testing.T) {
+	m := New[int](WithShardCount[int](1))
+	_, unlock := m.LockShard(0)
+	errs := make(chan error)
+	go func() {
+		errs <- m.Set("a", 1)
+	}()
+	go func() {
+		defer func() {
+			err, _ := recover().(error)
+			errs <- err
+		}()
+		m.MSet(map[string]int{"b": 2})
+	}()
+	// Let the writers pass their first check and block on the lock, then
+	// flip the flag as Freeze does while it holds the locks.
+	time.Sleep(10 * time.Millisecond)
+	m.frozen.Store(true)
+	unlock()
+	for i := 0; i < 2; i++ {
+		var freezeErr *FreezeError
+		if err := <-errs; !errors.As(err, &freezeErr) {
+			t.Errorf("expected a *FreezeError, got %v", err)
+		}
+	}
+	if m.Count() != 0 {
+		t.Errorf("writes should not reach a frozen map, got %v", m.Items())
+	}
+}
+
+func TestBatchUpsertBounded(t *testing.T) {
+	keep := func(exist bool, valueInMap, newValue int) int { return newValue }
+	var evicted []string
+	m := New[int](WithShardCount[int](1), WithMaxSize[int](2), WithOnEvict(func(key string, v int) {
+		evicted = append(evicted, key)
+	}))
+	stored := m.BatchUpsertKeys([]string{"a", "b", "c", "d"}, 1, keep)
+	if !reflect.DeepEqual(stored, m.Items()) || m.Count() != 2 || len(evicted) != 2 {
+		t.Errorf("expected the returned values %v to match the map %v after 2 evictions, got %v", stored, m.Items(), evicted)
+	}
+	m.BatchUpsert(map[string]int{"e": 1}, keep)
+	if m.Count() != 2 || !m.Has("e") || len(evicted) != 3 {
+		t.Errorf("BatchUpsert should evict too, got %v", m.Items())
+	}
+
+	full := New[int](WithMaxSize[int](2))
+	full.Set("a", 1)
+	full.Set("b", 1)
+	stored = full.BatchUpsertKeys([]string{"a", "c"}, 5, func(exist bool, valueInMap, newValue int) int {
+		return valueInMap + newValue
+	})
+	if !reflect.DeepEqual(stored, map[string]int{"a": 6}) || full.Has("c") {
+		t.Errorf("new keys of a full map should be skipped, got %v", stored)
+	}
+	full.BatchUpsert(map[string]int{"d": 1, "b": 2}, keep)
+	if full.Has("d") || full.Count() != 2 {
+		t.Errorf("BatchUpsert should skip new keys of a full map, got %v", full.Items())
+	}
+	if v, _ := full.Get("b"); v != 2 {
+		t.Errorf("BatchUpsert should still update existing keys, got %d", v)
+	}
+}
+
+func TestWithOnEvictBulkWrites(t *testing.T) {
+	newMap := func() *ConcurrentMap[int] {
+		return New[int](WithShardCount[int](1), WithMaxSize[int](3), WithOnEvict(func(string, int) {}))
+	}
+	data := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		data[strconv.Itoa(i)] = i
+	}
+
+	m := newMap()
+	m.MSetCount(data)
+	if m.Count() != 3 {
+		t.Errorf("MSetCount: expected 3 items, got %d", m.Count())
+	}
+
+	m = newMap()
+	ch := make(chan Tuple[int], len(data))
+	for key, v := range data {
+		ch <- Tuple[int]{key, v}
+	}
+	close(ch)
+	m.SetBulkFromChannel(ch)
+	if m.Count() != 3 {
+		t.Errorf("SetBulkFromChannel: expected 3 items, got %d", m.Count())
+	}
+
+	m = newMap()
+	m.Transaction(func(tx *Tx[int]) error {
+		for key, v := range data {
+			tx.Set(key, v)
+		}
+		return nil
+	})
+	if m.Count() != 3 {
+		t.Errorf("Transaction: expected 3 items, got %d", m.Count())
+	}
+
+	m = newMap()
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	m.Transact(keys, func(txn *Txn[int]) error {
+		for key, v := range data {
+			txn.Set(key, v)
+		}
+		return nil
+	})
+	if m.Count() != 3 || len(m.Items()) != 3 {
+		t.Errorf("Transact: expected 3 items, got %d", m.Count())
+	}
+}
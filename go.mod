@@ -1,3 +1,5 @@
-module github.com/chuxin0816/concurrent-map
+module github.com/chuxin0816/concurrent-map/v2
 
 go 1.23
+
+require gopkg.in/yaml.v3 v3.0.1
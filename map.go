@@ -0,0 +1,247 @@
+package cmap
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Map is a sharded concurrent map with keys of any comparable type.
+// It offers the core operations of ConcurrentMap, for string keys with the
+// extra features prefer ConcurrentMap. Like ConcurrentMap, a zero value Map
+// is ready to use and is initialized with the default options on first
+// use, which panics if K has no default sharding.
+type Map[K comparable, V any] struct {
+	shardCount int
+	shards     []*mapShard[K, V]
+	sharding   func(key K) uint64
+	// count is the number of items across all shards, maintained by every
+	// write under the lock of the modified shard.
+	count atomic.Int64
+	// initOnce guards the initialization of the map, either in NewMap or
+	// lazily on first use of a zero value map.
+	initOnce sync.Once
+}
+
+type mapShard[K comparable, V any] struct {
+	items map[K]V
+	sync.RWMutex
+}
+
+// MapOption configures a Map created with NewMap.
+type MapOption[K comparable, V any] func(*Map[K, V])
+
+// WithMapShardCount sets the number of shards of a Map, which must be
+// positive.
+func WithMapShardCount[K comparable, V any](shardCount int) MapOption[K, V] {
+	return func(m *Map[K, V]) {
+		m.shardCount = shardCount
+	}
+}
+
+// WithKeySharding sets the function hashing keys to shards. It is required
+// for key types without a default, which exists for strings and integers.
+func WithKeySharding[K comparable, V any](sharding func(key K) uint64) MapOption[K, V] {
+	return func(m *Map[K, V]) {
+		m.sharding = sharding
+	}
+}
+
+// NewMap creates a new Map. It panics if the shard count is not positive
+// or if K has no default sharding and WithKeySharding is not given.
+func NewMap[K comparable, V any](opts ...MapOption[K, V]) *Map[K, V] {
+	m := &Map[K, V]{}
+	m.initOnce.Do(func() { m.init(opts) })
+	return m
+}
+
+// lazyInit initializes a zero value map with the default options.
+func (m *Map[K, V]) lazyInit() {
+	m.initOnce.Do(func() { m.init(nil) })
+}
+
+// init applies opts on top of the defaults and allocates the shards.
+func (m *Map[K, V]) init(opts []MapOption[K, V]) {
+	m.shardCount = SHARD_COUNT
+	for _, opt := range opts {
+		opt(m)
+	}
+	if m.shardCount <= 0 {
+		panic(ErrShardCountNotPositive)
+	}
+	if m.sharding == nil {
+		m.sharding = defaultSharding[K]()
+		if m.sharding == nil {
+			var zero K
+			panic(fmt.Sprintf("cmap: no default sharding for key type %T, use WithKeySharding", zero))
+		}
+	}
+	m.shards = make([]*mapShard[K, V], m.shardCount)
+	for i := range m.shards {
+		m.shards[i] = &mapShard[K, V]{items: make(map[K]V)}
+	}
+}
+
+// defaultSharding returns the sharding function used for K when none is
+// given, or nil if there is no default for K.
+func defaultSharding[K comparable]() func(key K) uint64 {
+	var zero K
+	switch any(zero).(type) {
+	case string:
+		return func(key K) uint64 { return fnv64a(any(key).(string)) }
+	case int:
+		return func(key K) uint64 { return mix64(uint64(any(key).(int))) }
+	case int32:
+		return func(key K) uint64 { return mix64(uint64(any(key).(int32))) }
+	case int64:
+		return func(key K) uint64 { return mix64(uint64(any(key).(int64))) }
+	case uint:
+		return func(key K) uint64 { return mix64(uint64(any(key).(uint))) }
+	case uint32:
+		return func(key K) uint64 { return mix64(uint64(any(key).(uint32))) }
+	case uint64:
+		return func(key K) uint64 { return mix64(any(key).(uint64)) }
+	}
+	return nil
+}
+
+// mix64 scrambles the bits of x, so sequential integer keys are spread
+// over the shards. It is the finalizer of MurmurHash3.
+func mix64(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (m *Map[K, V]) getShard(key K) *mapShard[K, V] {
+	m.lazyInit()
+	return m.shards[uint(m.sharding(key))%uint(m.shardCount)]
+}
+
+// Set sets the given value under the specified key.
+func (m *Map[K, V]) Set(key K, value V) {
+	shard := m.getShard(key)
+	shard.Lock()
+	if _, ok := shard.items[key]; !ok {
+		m.count.Add(1)
+	}
+	shard.items[key] = value
+	shard.Unlock()
+}
+
+// SetIfAbsent sets value under key if no value was associated with it,
+// and reports whether it did.
+func (m *Map[K, V]) SetIfAbsent(key K, value V) bool {
+	shard := m.getShard(key)
+	shard.Lock()
+	_, ok := shard.items[key]
+	if !ok {
+		shard.items[key] = value
+		m.count.Add(1)
+	}
+	shard.Unlock()
+	return !ok
+}
+
+// Upsert updates the element under key, or inserts it, with the value
+// returned by cb. The same locking rules as for ConcurrentMap.Upsert apply.
+func (m *Map[K, V]) Upsert(key K, value V, cb func(exist bool, valueInMap V, newValue V) V) V {
+	shard := m.getShard(key)
+	shard.Lock()
+	v, ok := shard.items[key]
+	res := cb(ok, v, value)
+	shard.items[key] = res
+	if !ok {
+		m.count.Add(1)
+	}
+	shard.Unlock()
+	return res
+}
+
+// Get retrieves an element from map under given key.
+func (m *Map[K, V]) Get(key K) (V, bool) {
+	shard := m.getShard(key)
+	shard.RLock()
+	val, ok := shard.items[key]
+	shard.RUnlock()
+	return val, ok
+}
+
+// Has looks up an item under specified key.
+func (m *Map[K, V]) Has(key K) bool {
+	_, ok := m.Get(key)
+	return ok
+}
+
+// Remove removes an element from the map.
+func (m *Map[K, V]) Remove(key K) {
+	m.Pop(key)
+}
+
+// Pop removes an element from the map and returns it.
+func (m *Map[K, V]) Pop(key K) (v V, exists bool) {
+	shard := m.getShard(key)
+	shard.Lock()
+	v, exists = shard.items[key]
+	if exists {
+		delete(shard.items, key)
+		m.count.Add(-1)
+	}
+	shard.Unlock()
+	return v, exists
+}
+
+// Count returns the number of elements within the map, in O(1).
+func (m *Map[K, V]) Count() int {
+	return int(m.count.Load())
+}
+
+// IsEmpty checks if map is empty.
+func (m *Map[K, V]) IsEmpty() bool {
+	return m.Count() == 0
+}
+
+// IterCb calls fn for every element, shard after shard, each under its
+// read lock. fn MUST NOT write to m.
+func (m *Map[K, V]) IterCb(fn func(key K, v V)) {
+	m.lazyInit()
+	for _, shard := range m.shards {
+		shard.RLock()
+		for key, value := range shard.items {
+			fn(key, value)
+		}
+		shard.RUnlock()
+	}
+}
+
+// Keys returns all keys. Each shard is read under its read lock.
+func (m *Map[K, V]) Keys() []K {
+	keys := make([]K, 0, m.Count())
+	m.IterCb(func(key K, _ V) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// Items returns all items as a native map.
+func (m *Map[K, V]) Items() map[K]V {
+	items := make(map[K]V, m.Count())
+	m.IterCb(func(key K, v V) {
+		items[key] = v
+	})
+	return items
+}
+
+// Clear removes all items from map.
+func (m *Map[K, V]) Clear() {
+	m.lazyInit()
+	for _, shard := range m.shards {
+		shard.Lock()
+		m.count.Add(-int64(len(shard.items)))
+		shard.items = make(map[K]V)
+		shard.Unlock()
+	}
+}
@@ -0,0 +1,112 @@
+package cmap
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMapIntKeys(t *testing.T) {
+	m := NewMap[int64, string]()
+	for i := int64(0); i < 1000; i++ {
+		m.Set(i, strconv.FormatInt(i, 10))
+	}
+	if m.Count() != 1000 {
+		t.Errorf("expected 1000 elements, got %d", m.Count())
+	}
+	if v, ok := m.Get(42); !ok || v != "42" {
+		t.Error("missing element 42.")
+	}
+	used := 0
+	for _, shard := range m.shards {
+		if len(shard.items) > 0 {
+			used++
+		}
+	}
+	if used < SHARD_COUNT/2 {
+		t.Errorf("sequential keys should be spread over the shards, %d used", used)
+	}
+
+	if v, ok := m.Pop(42); !ok || v != "42" || m.Has(42) {
+		t.Error("Pop should remove and return the element.")
+	}
+	m.Remove(43)
+	if m.Count() != 998 || len(m.Keys()) != 998 || len(m.Items()) != 998 {
+		t.Error("expected 998 elements after the removals.")
+	}
+	m.Clear()
+	if !m.IsEmpty() {
+		t.Error("map should be empty after Clear.")
+	}
+}
+
+func TestMapZeroValue(t *testing.T) {
+	var m Map[int, string]
+	if !m.IsEmpty() || len(m.Keys()) != 0 {
+		t.Error("a zero value map should be empty.")
+	}
+	m.Set(1, "one")
+	if v, ok := m.Get(1); !ok || v != "one" || m.Count() != 1 {
+		t.Error("a zero value map should be usable.")
+	}
+	if len(m.shards) != SHARD_COUNT {
+		t.Errorf("expected %d shards, got %d", SHARD_COUNT, len(m.shards))
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("expected a panic for a key type without default sharding.")
+		}
+	}()
+	var custom Map[[2]int, string]
+	custom.Set([2]int{1, 2}, "a")
+}
+
+func TestMapStringKeysConcurrent(t *testing.T) {
+	m := NewMap[string, int](WithMapShardCount[string, int](8))
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.Upsert(strconv.Itoa(i), 1, func(exist bool, valueInMap, newValue int) int {
+					return valueInMap + newValue
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if m.Count() != 100 {
+		t.Errorf("expected 100 elements, got %d", m.Count())
+	}
+	m.IterCb(func(key string, v int) {
+		if v != 4 {
+			t.Errorf("%s should have been upserted 4 times, got %d", key, v)
+		}
+	})
+	if m.SetIfAbsent("1", 0) || !m.SetIfAbsent("new", 0) {
+		t.Error("SetIfAbsent should only set absent keys.")
+	}
+}
+
+func TestMapCustomKeys(t *testing.T) {
+	type uuid [16]byte
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("a key type without default sharding should panic.")
+			}
+		}()
+		NewMap[uuid, int]()
+	}()
+
+	m := NewMap[uuid, int](WithKeySharding[uuid, int](func(key uuid) uint64 {
+		return fnv64a(string(key[:]))
+	}))
+	m.Set(uuid{1}, 1)
+	m.Set(uuid{2}, 2)
+	if v, _ := m.Get(uuid{2}); v != 2 || m.Count() != 2 {
+		t.Error("custom keys should be stored.")
+	}
+}
@@ -0,0 +1,175 @@
+package cmap
+
+import (
+	"reflect"
+	"sync"
+)
+
+// MutationLogger is told about the mutations of a map configured with
+// WithMutationLog. Its methods are called after the shard lock has been
+// released, so they may access the map, but mutations of the same key made
+// concurrently may be logged in another order than they were applied.
+type MutationLogger[V any] interface {
+	// LogSet reports that key was set to newVal, hadOld reports whether it
+	// previously held oldVal.
+	LogSet(key string, oldVal V, newVal V, hadOld bool)
+	// LogDelete reports a removal of key, existed reports whether it held
+	// val.
+	LogDelete(key string, val V, existed bool)
+}
+
+// WithMutationLog makes Set, Upsert, Remove, Pop and RemoveCb (when it
+// removes) report their mutations to log.
+func WithMutationLog[V any](log MutationLogger[V]) Option[V] {
+	return func(cm *ConcurrentMap[V]) {
+		cm.mutationLog = log
+	}
+}
+
+// Mutation is an entry of a MemoryMutationLog.
+type Mutation[V any] struct {
+	Key     string
+	Deleted bool
+	// Old is the value held before the mutation, if HadOld is set.
+	Old    V
+	HadOld bool
+	// New is the value set, zero for deletions.
+	New V
+}
+
+// MemoryMutationLog is a MutationLogger keeping the most recent mutations
+// in a fixed size ring buffer. It is safe for concurrent use.
+type MemoryMutationLog[V any] struct {
+	mu   sync.Mutex
+	ring []Mutation[V]
+	// start is the index of the oldest mutation, size the number of
+	// mutations retained.
+	start int
+	size  int
+}
+
+// NewMemoryMutationLog creates a log keeping the last capacity mutations.
+// It panics if capacity is not positive.
+func NewMemoryMutationLog[V any](capacity int) *MemoryMutationLog[V] {
+	if capacity <= 0 {
+		panic("cmap: mutation log capacity must be greater than 0")
+	}
+	return &MemoryMutationLog[V]{ring: make([]Mutation[V], capacity)}
+}
+
+func (l *MemoryMutationLog[V]) append(m Mutation[V]) {
+	l.mu.Lock()
+	if l.size == len(l.ring) {
+		// Overwrite the oldest mutation.
+		l.ring[l.start] = m
+		l.start = (l.start + 1) % len(l.ring)
+	} else {
+		l.ring[(l.start+l.size)%len(l.ring)] = m
+		l.size++
+	}
+	l.mu.Unlock()
+}
+
+// LogSet implements MutationLogger.
+func (l *MemoryMutationLog[V]) LogSet(key string, oldVal V, newVal V, hadOld bool) {
+	l.append(Mutation[V]{Key: key, Old: oldVal, HadOld: hadOld, New: newVal})
+}
+
+// LogDelete implements MutationLogger.
+func (l *MemoryMutationLog[V]) LogDelete(key string, val V, existed bool) {
+	l.append(Mutation[V]{Key: key, Deleted: true, Old: val, HadOld: existed})
+}
+
+// Mutations returns the retained mutations, oldest first.
+func (l *MemoryMutationLog[V]) Mutations() []Mutation[V] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	mutations := make([]Mutation[V], l.size)
+	for i := range mutations {
+		mutations[i] = l.ring[(l.start+i)%len(l.ring)]
+	}
+	return mutations
+}
+
+// PopLast removes and returns the most recent retained mutation of key if
+// match returns true for it. match is called with the log locked.
+func (l *MemoryMutationLog[V]) PopLast(key string, match func(m Mutation[V]) bool) (Mutation[V], bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slot := func(i int) *Mutation[V] {
+		return &l.ring[(l.start+i)%len(l.ring)]
+	}
+	// Walk back from the newest mutation.
+	for i := l.size - 1; i >= 0; i-- {
+		mutation := *slot(i)
+		if mutation.Key != key {
+			continue
+		}
+		if !match(mutation) {
+			return Mutation[V]{}, false
+		}
+		// Shift the newer mutations back over the popped one.
+		for j := i; j < l.size-1; j++ {
+			*slot(j) = *slot(j + 1)
+		}
+		*slot(l.size - 1) = Mutation[V]{}
+		l.size--
+		return mutation, true
+	}
+	return Mutation[V]{}, false
+}
+
+// undoLog is implemented by the mutation logs Undo can work with, such as
+// MemoryMutationLog.
+type undoLog[V any] interface {
+	PopLast(key string, match func(m Mutation[V]) bool) (Mutation[V], bool)
+}
+
+// Undo reverts the last logged mutation of key, if the map has a mutation
+// log supporting it (see MemoryMutationLog) and the value of key is still
+// the one the mutation left, compared with reflect.DeepEqual. It restores
+// the previous value, or removes key if the mutation inserted it, and
+// reports whether it did. The mutation is removed from the log and the
+// revert itself is not logged, so repeated calls walk back the history.
+// Logged removals of absent keys changed nothing, they are dropped on the
+// way to the mutation to revert.
+func (m *ConcurrentMap[V]) Undo(key string) bool {
+	m.checkWrite()
+	log, ok := m.mutationLog.(undoLog[V])
+	if !ok {
+		return false
+	}
+	key = m.normalize(key)
+	shard := m.getShard(key)
+	m.mustLockWrite(shard)
+	defer shard.Unlock()
+	noop := func(mutation Mutation[V]) bool {
+		return mutation.Deleted && !mutation.HadOld
+	}
+	var mutation Mutation[V]
+	for {
+		mutation, ok = log.PopLast(key, func(mutation Mutation[V]) bool {
+			if noop(mutation) {
+				return true
+			}
+			current, exists := shard.items[key]
+			if mutation.Deleted {
+				return !exists
+			}
+			return exists && reflect.DeepEqual(current, mutation.New)
+		})
+		if !ok {
+			return false
+		}
+		if !noop(mutation) {
+			break
+		}
+	}
+	if mutation.HadOld {
+		m.evict(shard, key)
+		m.put(shard, key, mutation.Old)
+	} else {
+		m.del(shard, key)
+	}
+	return true
+}
@@ -0,0 +1,148 @@
+package cmap
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+func TestWithMutationLog(t *testing.T) {
+	log := NewMemoryMutationLog[int](10)
+	m := New[int](WithMutationLog[int](log))
+
+	m.Set("a", 1)
+	m.Set("a", 2)
+	m.Upsert("a", 3, func(exist bool, valueInMap, newValue int) int {
+		return valueInMap + newValue
+	})
+	m.Remove("a")
+	m.Remove("a")
+	m.Set("b", 1)
+	m.Pop("b")
+	m.Set("c", 1)
+	m.RemoveCb("c", func(key string, v int, exists bool) bool { return false })
+	m.RemoveCb("c", func(key string, v int, exists bool) bool { return true })
+
+	expected := []Mutation[int]{
+		{Key: "a", New: 1},
+		{Key: "a", Old: 1, HadOld: true, New: 2},
+		{Key: "a", Old: 2, HadOld: true, New: 5},
+		{Key: "a", Deleted: true, Old: 5, HadOld: true},
+		{Key: "a", Deleted: true},
+		{Key: "b", New: 1},
+		{Key: "b", Deleted: true, Old: 1, HadOld: true},
+		{Key: "c", New: 1},
+		{Key: "c", Deleted: true, Old: 1, HadOld: true},
+	}
+	mutations := log.Mutations()
+	if len(mutations) != len(expected) {
+		t.Fatalf("expected %d mutations, got %v", len(expected), mutations)
+	}
+	for i := range expected {
+		if mutations[i] != expected[i] {
+			t.Errorf("mutation %d: expected %+v, got %+v", i, expected[i], mutations[i])
+		}
+	}
+}
+
+func TestMemoryMutationLogRing(t *testing.T) {
+	log := NewMemoryMutationLog[int](3)
+	for i := 0; i < 5; i++ {
+		log.LogSet(strconv.Itoa(i), 0, i, false)
+	}
+	mutations := log.Mutations()
+	if len(mutations) != 3 {
+		t.Fatalf("expected 3 mutations, got %d", len(mutations))
+	}
+	for i, mutation := range mutations {
+		if mutation.New != i+2 {
+			t.Errorf("expected the last mutations oldest first, got %v", mutations)
+		}
+	}
+}
+
+func TestUndo(t *testing.T) {
+	log := NewMemoryMutationLog[int](10)
+	m := New[int](WithMutationLog[int](log))
+
+	m.Set("a", 1)
+	m.Set("b", 1)
+	m.Set("a", 2)
+	m.Remove("a")
+
+	if !m.Undo("a") {
+		t.Fatal("undo of the removal should be applied.")
+	}
+	if v, ok := m.Get("a"); !ok || v != 2 {
+		t.Errorf("expected a=2, got %d", v)
+	}
+	if !m.Undo("a") {
+		t.Fatal("undo of the update should be applied.")
+	}
+	if v, _ := m.Get("a"); v != 1 {
+		t.Errorf("expected a=1, got %d", v)
+	}
+	if !m.Undo("a") || m.Has("a") {
+		t.Error("undo of the insertion should remove a.")
+	}
+	if m.Undo("a") {
+		t.Error("nothing should be left to undo for a.")
+	}
+	if m.Count() != 1 || !m.Has("b") {
+		t.Error("other keys should not be touched.")
+	}
+
+	// An intervening mutation the log does not know about blocks the undo.
+	m.Set("c", 1)
+	m.WithShardWrite("c", func(items map[string]int) { items["c"] = 5 })
+	if m.Undo("c") {
+		t.Error("undo should detect the intervening mutation.")
+	}
+	if v, _ := m.Get("c"); v != 5 {
+		t.Error("a refused undo should not change the value.")
+	}
+
+	// Removals of absent keys changed nothing and are skipped.
+	m.Set("d", 1)
+	m.Remove("d")
+	m.Remove("d")
+	if !m.Undo("d") {
+		t.Fatal("undo should skip the no-op removal.")
+	}
+	if v, ok := m.Get("d"); !ok || v != 1 {
+		t.Errorf("expected d=1, got %d", v)
+	}
+	m.Remove("e")
+	if m.Undo("e") {
+		t.Error("a no-op removal alone should not be undoable.")
+	}
+
+	if New[int]().Undo("a") {
+		t.Error("maps without a mutation log cannot undo.")
+	}
+}
+
+func TestMemoryMutationLogPopLast(t *testing.T) {
+	log := NewMemoryMutationLog[int](4)
+	for i := 0; i < 6; i++ {
+		log.LogSet(strconv.Itoa(i%3), 0, i, false)
+	}
+	// Retained: 2, 3, 4, 5 with keys 2, 0, 1, 2.
+	if m, ok := log.PopLast("0", func(Mutation[int]) bool { return true }); !ok || m.New != 3 {
+		t.Errorf("unexpected popped mutation %+v", m)
+	}
+	log.LogSet("x", 0, 9, false)
+	if m, ok := log.PopLast("2", func(Mutation[int]) bool { return true }); !ok || m.New != 5 {
+		t.Errorf("unexpected popped mutation %+v", m)
+	}
+	if _, ok := log.PopLast("1", func(Mutation[int]) bool { return false }); ok {
+		t.Error("a mutation refused by match should not be popped.")
+	}
+	var values []int
+	for _, m := range log.Mutations() {
+		values = append(values, m.New)
+	}
+	if fmt.Sprint(values) != "[2 4 9]" {
+		t.Errorf("unexpected retained mutations %v", values)
+	}
+}
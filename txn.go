@@ -0,0 +1,205 @@
+package cmap
+
+import "sort"
+
+// Txn gives access to the keys of a transaction started with Transact.
+// Writes are buffered and applied only if the transaction function succeeds.
+type Txn[V any] struct {
+	m      *ConcurrentMap[V]
+	keys   map[string]struct{}
+	writes map[string]txnWrite[V]
+	// err is the first key rejected by Set, see WithKeyValidator.
+	err error
+}
+
+type txnWrite[V any] struct {
+	val     V
+	deleted bool
+}
+
+// Transact runs fn with exclusive access to keys, which may live in
+// different shards. The shards of keys are write locked in ascending index
+// order, so concurrent transactions cannot deadlock, and unlocked in
+// reverse order once fn returns. Writes made through txn are applied if fn
+// returns nil and discarded otherwise; the error of fn is returned as is.
+// It fails without calling fn if the map is disposed or frozen.
+// fn MUST NOT call back into the map.
+func (m *ConcurrentMap[V]) Transact(keys []string, fn func(txn *Txn[V]) error) error {
+	if err := m.writeErr(); err != nil {
+		return err
+	}
+	txn := &Txn[V]{
+		m:      m,
+		keys:   make(map[string]struct{}, len(keys)),
+		writes: make(map[string]txnWrite[V]),
+	}
+	var indices []int
+	seen := make(map[uint]struct{})
+	for _, key := range keys {
+		key = m.normalize(key)
+		txn.keys[key] = struct{}{}
+		idx := m.shardIndex(key)
+		if _, ok := seen[idx]; !ok {
+			seen[idx] = struct{}{}
+			indices = append(indices, int(idx))
+		}
+	}
+	sort.Ints(indices)
+	for _, idx := range indices {
+		m.shards[idx].lock()
+	}
+	defer func() {
+		for i := len(indices) - 1; i >= 0; i-- {
+			m.shards[indices[i]].Unlock()
+		}
+	}()
+	// Freeze may have run while waiting for the locks.
+	if err := m.writeErr(); err != nil {
+		return err
+	}
+
+	if err := fn(txn); err != nil {
+		return err
+	}
+	if txn.err != nil {
+		return txn.err
+	}
+	for key, w := range txn.writes {
+		shard := m.shards[m.shardIndex(key)]
+		if w.deleted {
+			m.del(shard, key)
+		} else {
+			m.evict(shard, key)
+			m.put(shard, key, w.val)
+		}
+	}
+	return nil
+}
+
+// check normalizes key and panics if it was not declared when the
+// transaction was started.
+func (txn *Txn[V]) check(key string) string {
+	key = txn.m.normalize(key)
+	if _, ok := txn.keys[key]; !ok {
+		panic(txn.m.prefix() + ": key " + key + " is not part of the transaction")
+	}
+	return key
+}
+
+// Get retrieves the value of key, including the writes of the transaction.
+func (txn *Txn[V]) Get(key string) (V, bool) {
+	key = txn.check(key)
+	if w, ok := txn.writes[key]; ok {
+		return w.val, !w.deleted
+	}
+	v, ok := txn.m.shards[txn.m.shardIndex(key)].items[key]
+	return v, ok
+}
+
+// Set sets the given value under key once the transaction commits.
+// If key is rejected by the validator of the map, the transaction is
+// aborted and Transact returns the error.
+func (txn *Txn[V]) Set(key string, value V) {
+	key = txn.check(key)
+	if err := txn.m.validate(key); err != nil {
+		if txn.err == nil {
+			txn.err = err
+		}
+		return
+	}
+	txn.writes[key] = txnWrite[V]{val: value}
+}
+
+// Remove removes key once the transaction commits.
+func (txn *Txn[V]) Remove(key string) {
+	key = txn.check(key)
+	txn.writes[key] = txnWrite[V]{deleted: true}
+}
+
+// Tx records the mutations of a transaction started with Transaction.
+// Nothing is locked while they are recorded, they are all applied at once
+// when the transaction function returns nil.
+type Tx[V any] struct {
+	m      *ConcurrentMap[V]
+	writes map[string]txnWrite[V]
+	// shards are the indices of the shards touched by writes.
+	shards map[int]struct{}
+	// err is the first key rejected by Set, see WithKeyValidator.
+	err error
+}
+
+// Transaction runs fn, then applies the mutations it recorded in tx
+// atomically: the shards they touch are write locked in ascending index
+// order, so concurrent transactions cannot deadlock, every mutation is
+// applied, and the locks are released. If fn returns an error, or a key is
+// rejected, nothing is applied and the error is returned. Unlike Transact,
+// keys need not be known in advance, but values cannot be read under the
+// transaction's locks.
+func (m *ConcurrentMap[V]) Transaction(fn func(tx *Tx[V]) error) error {
+	if err := m.writeErr(); err != nil {
+		return err
+	}
+	tx := &Tx[V]{
+		m:      m,
+		writes: make(map[string]txnWrite[V]),
+		shards: make(map[int]struct{}),
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	indices := make([]int, 0, len(tx.shards))
+	for idx := range tx.shards {
+		indices = append(indices, idx)
+	}
+	sort.Ints(indices)
+	for _, idx := range indices {
+		m.shards[idx].lock()
+	}
+	defer func() {
+		for i := len(indices) - 1; i >= 0; i-- {
+			m.shards[indices[i]].Unlock()
+		}
+	}()
+	// Freeze may have run while waiting for the locks.
+	if err := m.writeErr(); err != nil {
+		return err
+	}
+	for key, w := range tx.writes {
+		shard := m.shards[m.shardIndex(key)]
+		if w.deleted {
+			m.del(shard, key)
+		} else {
+			m.evict(shard, key)
+			m.put(shard, key, w.val)
+		}
+	}
+	return nil
+}
+
+// record adds a mutation of key to the transaction.
+func (tx *Tx[V]) record(key string, w txnWrite[V]) {
+	tx.writes[key] = w
+	tx.shards[int(tx.m.shardIndex(key))] = struct{}{}
+}
+
+// Set sets the given value under key once the transaction commits.
+// If key is rejected by the validator of the map, the transaction is
+// aborted and Transaction returns the error.
+func (tx *Tx[V]) Set(key string, value V) {
+	key = tx.m.normalize(key)
+	if err := tx.m.validate(key); err != nil {
+		if tx.err == nil {
+			tx.err = err
+		}
+		return
+	}
+	tx.record(key, txnWrite[V]{val: value})
+}
+
+// Remove removes key once the transaction commits.
+func (tx *Tx[V]) Remove(key string) {
+	tx.record(tx.m.normalize(key), txnWrite[V]{deleted: true})
+}
@@ -0,0 +1,204 @@
+package cmap
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestTransact(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 10)
+	m.Set("b", 20)
+
+	err := m.Transact([]string{"a", "b", "c"}, func(txn *Txn[int]) error {
+		a, _ := txn.Get("a")
+		b, _ := txn.Get("b")
+		txn.Set("c", a+b)
+		txn.Remove("a")
+		if _, ok := txn.Get("a"); ok {
+			t.Error("removed key should not be visible within the transaction.")
+		}
+		if c, _ := txn.Get("c"); c != 30 {
+			t.Error("written key should be visible within the transaction.")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Has("a") || m.Count() != 2 {
+		t.Error("transaction should have removed a.")
+	}
+	if c, _ := m.Get("c"); c != 30 {
+		t.Error("transaction should have set c.")
+	}
+}
+
+func TestTransactRollback(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 10)
+
+	errAbort := errors.New("abort")
+	err := m.Transact([]string{"a"}, func(txn *Txn[int]) error {
+		txn.Set("a", 0)
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("expected the error of the transaction, got %v", err)
+	}
+	if a, _ := m.Get("a"); a != 10 {
+		t.Error("failed transaction should not apply its writes.")
+	}
+}
+
+func TestTransactOutOfScope(t *testing.T) {
+	m := New[int]()
+	defer func() {
+		if recover() == nil {
+			t.Error("accessing an undeclared key should panic.")
+		}
+	}()
+	m.Transact([]string{"a"}, func(txn *Txn[int]) error {
+		txn.Set("b", 1)
+		return nil
+	})
+}
+
+func TestTransactFrozenOrDisposed(t *testing.T) {
+	called := false
+	fn := func(txn *Txn[int]) error {
+		called = true
+		return nil
+	}
+	m := New[int]()
+	m.Freeze()
+	var freezeErr *FreezeError
+	if err := m.Transact([]string{"a"}, fn); !errors.As(err, &freezeErr) {
+		t.Errorf("expected a *FreezeError, got %v", err)
+	}
+	m = New[int]()
+	m.Dispose()
+	if err := m.Transact([]string{"a"}, fn); !errors.Is(err, ErrDisposed) {
+		t.Errorf("expected ErrDisposed, got %v", err)
+	}
+	if called {
+		t.Error("fn should not run on a frozen or disposed map.")
+	}
+}
+
+func TestTransactConcurrentTransfers(t *testing.T) {
+	m := New[int]()
+	const accounts = 10
+	const balance = 1000
+	for i := 0; i < accounts; i++ {
+		m.Set(strconv.Itoa(i), balance)
+	}
+
+	wg := sync.WaitGroup{}
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				from := strconv.Itoa((w + i) % accounts)
+				to := strconv.Itoa((w + 3*i + 1) % accounts)
+				if from == to {
+					continue
+				}
+				m.Transact([]string{from, to}, func(txn *Txn[int]) error {
+					a, _ := txn.Get(from)
+					b, _ := txn.Get(to)
+					txn.Set(from, a-7)
+					txn.Set(to, b+7)
+					return nil
+				})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	m.IterCb(func(key string, v int) {
+		total += v
+	})
+	if total != accounts*balance {
+		t.Errorf("transfers should preserve the total balance, got %d", total)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	m := New[int]()
+	m.Set("a", 1)
+	m.Set("b", 2)
+
+	err := m.Transaction(func(tx *Tx[int]) error {
+		tx.Set("c", 3)
+		tx.Remove("a")
+		tx.Set("b", 20)
+		if m.Has("c") {
+			t.Error("mutations should not be applied before the transaction ends.")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Has("a") || m.Count() != 2 {
+		t.Error("a should have been removed.")
+	}
+	if b, _ := m.Get("b"); b != 20 {
+		t.Error("b should have been updated.")
+	}
+	if c, _ := m.Get("c"); c != 3 {
+		t.Error("c should have been set.")
+	}
+
+	errAbort := errors.New("abort")
+	err = m.Transaction(func(tx *Tx[int]) error {
+		tx.Set("d", 4)
+		tx.Remove("b")
+		return errAbort
+	})
+	if err != errAbort {
+		t.Errorf("expected the error of fn, got %v", err)
+	}
+	if m.Has("d") || !m.Has("b") {
+		t.Error("a failed transaction should not be applied.")
+	}
+}
+
+func TestTransactionConcurrent(t *testing.T) {
+	m := New[int](WithShardCount[int](4))
+	keys := []string{"a", "b", "c", "d", "e"}
+	for _, key := range keys {
+		m.Set(key, 0)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				m.Transaction(func(tx *Tx[int]) error {
+					for _, key := range keys {
+						tx.Set(key, w)
+					}
+					return nil
+				})
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// Every transaction writes all keys at once, so they all hold the value
+	// of the last one.
+	first, _ := m.Get("a")
+	for _, key := range keys {
+		if v, _ := m.Get(key); v != first {
+			t.Errorf("%s = %d, expected %d", key, v, first)
+		}
+	}
+}